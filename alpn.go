@@ -0,0 +1,206 @@
+package continuous
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// alpnHandshakeTimeout is the time to wait for the TLS handshake which negotiates the protocol
+const alpnHandshakeTimeout = 10 * time.Second
+
+// ALPNProtocol is a protocol served by ALPNDispatcher, e.g. "h2", "http/1.1" or a custom one
+type ALPNProtocol struct {
+	Name   string
+	Server Continuous
+}
+
+// ALPNDispatcher dispatches the TLS connections to the servers by the protocol negotiated by ALPN, so the servers
+// of different protocols share a single listener. A connection without a known protocol goes to the first server.
+// The listener should be wrapped by the TLSConfig option with the config returned by TLSConfig
+//
+//	d := continuous.NewALPNDispatcher(
+//		continuous.ALPNProtocol{Name: "h2", Server: continuous.WrapGRPCServer(grpcServer)},
+//		continuous.ALPNProtocol{Name: "http/1.1", Server: continuous.WrapHTTPServer(httpServer)})
+//	cont.AddServer(d, listenOn, continuous.TLSConfig(d.TLSConfig(cfg)))
+type ALPNDispatcher struct {
+	protos []ALPNProtocol
+	routes map[string]*alpnListener
+	start  sync.Once
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+}
+
+// NewALPNDispatcher creates an ALPNDispatcher with the protocols in the order of preference
+func NewALPNDispatcher(protos ...ALPNProtocol) *ALPNDispatcher {
+	d := &ALPNDispatcher{protos: protos, routes: make(map[string]*alpnListener),
+		listeners: make(map[net.Listener]struct{})}
+	for _, p := range protos {
+		d.routes[p.Name] = &alpnListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	}
+	return d
+}
+
+// TLSConfig returns a copy of base which offers the protocols by NextProtos
+func (d *ALPNDispatcher) TLSConfig(base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cfg.NextProtos = nil
+	for _, p := range d.protos {
+		cfg.NextProtos = append(cfg.NextProtos, p.Name)
+	}
+	return cfg
+}
+
+// Serve accepts the connections and dispatches them, the servers are started on the first Serve
+// and keep serving when lis is closed by pausing
+func (d *ALPNDispatcher) Serve(lis net.Listener) error {
+	d.start.Do(func() {
+		for _, p := range d.protos {
+			l := d.routes[p.Name]
+			l.addr = lis.Addr()
+			go p.Server.Serve(l)
+		}
+	})
+
+	d.mu.Lock()
+	d.listeners[lis] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.listeners, lis)
+		d.mu.Unlock()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		// handshake in a new goroutine, so a slow client does not block the accept loop
+		go d.dispatch(conn)
+	}
+}
+
+func (d *ALPNDispatcher) dispatch(conn net.Conn) {
+	tc, ok := tlsConn(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	tc.SetDeadline(time.Now().Add(alpnHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	l, ok := d.routes[tc.ConnectionState().NegotiatedProtocol]
+	if !ok && len(d.protos) > 0 {
+		l = d.routes[d.protos[0].Name]
+	}
+	if l == nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Stop stops all the servers immediately
+func (d *ALPNDispatcher) Stop() error {
+	d.closeListeners()
+	var firstErr error
+	for _, p := range d.protos {
+		if err := p.Server.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// GracefulStop stops all the servers gracefully at the same time
+func (d *ALPNDispatcher) GracefulStop() error {
+	d.closeListeners()
+	errs := make(chan error, len(d.protos))
+	for _, p := range d.protos {
+		go func(srv Continuous) {
+			errs <- srv.GracefulStop()
+		}(p.Server)
+	}
+	var firstErr error
+	for range d.protos {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (d *ALPNDispatcher) closeListeners() {
+	d.mu.Lock()
+	for lis := range d.listeners {
+		lis.Close()
+	}
+	d.mu.Unlock()
+	for _, l := range d.routes {
+		l.Close()
+	}
+}
+
+// tlsConn finds the TLS connection by unwrapping conn
+func tlsConn(conn net.Conn) (*tls.Conn, bool) {
+	for {
+		if tc, ok := conn.(*tls.Conn); ok {
+			return tc, true
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = nc.NetConn()
+	}
+}
+
+// alpnListener is the listener of a protocol, it accepts the connections dispatched to it
+type alpnListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	addr  net.Addr
+}
+
+// errListenerClosed is returned by accepting on a closed listener, it has the message of the error of net
+var errListenerClosed = errors.New("use of closed network connection")
+
+func (l *alpnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *alpnListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *alpnListener) Addr() net.Addr {
+	return l.addr
+}
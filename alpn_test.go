@@ -0,0 +1,45 @@
+package continuous
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestALPNDispatcher(t *testing.T) {
+	named := func(name string) ALPNProtocol {
+		return ALPNProtocol{Name: name, Server: WrapTCPServer(func(conn net.Conn) {
+			conn.Write([]byte(name))
+		})}
+	}
+	d := NewALPNDispatcher(named("proto-a"), named("proto-b"))
+	cont := newTestCont(t)
+	cfg := d.TLSConfig(&tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost")}})
+	if err := cont.AddServer(d, &ListenOn{"tcp", "127.0.0.1:0"}, TLSConfig(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	addr := cont.servers[0].addr.String()
+
+	for _, c := range []struct {
+		protos []string
+		want   string
+	}{
+		{[]string{"proto-a"}, "proto-a"},
+		{[]string{"proto-b"}, "proto-b"},
+		// no protocol is negotiated, the first one serves
+		{nil, "proto-a"},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: c.protos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(got) != c.want {
+			t.Fatalf("protocols %v are served by %q(%v), want %s", c.protos, got, err, c.want)
+		}
+	}
+}
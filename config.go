@@ -0,0 +1,142 @@
+package continuous
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ContConfig is a snapshot of the effective configuration of Cont, for diagnostics
+type ContConfig struct {
+	ProcName   string `json:"proc_name"`
+	WorkDir    string `json:"work_dir"`
+	PidFile    string `json:"pid_file"`
+	Executable string `json:"executable"`
+	LogLevel   string `json:"log_level"`
+
+	Servers []ServerConfig `json:"servers"`
+
+	DrainTimeout           time.Duration `json:"drain_timeout"`
+	UpgradeTimeout         time.Duration `json:"upgrade_timeout"`
+	UpgradeDrainTimeout    time.Duration `json:"upgrade_drain_timeout"`
+	UpgradeWorkDir         string        `json:"upgrade_work_dir,omitempty"`
+	SigtermGraceful        time.Duration `json:"sigterm_graceful"`
+	UpgradeLimit           int           `json:"upgrade_limit"`
+	UpgradeWindow          time.Duration `json:"upgrade_window"`
+	MinUptimeBeforeUpgrade time.Duration `json:"min_uptime_before_upgrade"`
+	ConnStatsInterval      time.Duration `json:"conn_stats_interval"`
+	StatusServer           string        `json:"status_server,omitempty"`
+	ShutdownReportFile     string        `json:"shutdown_report_file,omitempty"`
+	DrainCompleteFile      string        `json:"drain_complete_file,omitempty"`
+	IgnoredSignals         []string      `json:"ignored_signals,omitempty"`
+	ShutdownLadder         []string      `json:"shutdown_ladder,omitempty"`
+
+	WatchBinary       bool `json:"watch_binary"`
+	AllowEmpty        bool `json:"allow_empty"`
+	JobControl        bool `json:"job_control"`
+	KeepGOMAXPROCS    bool `json:"keep_gomaxprocs"`
+	LogShutdownReport bool `json:"log_shutdown_report"`
+	SerializeState    bool `json:"serialize_state"`
+	Metrics           bool `json:"metrics"`
+	Warmup            bool `json:"warmup"`
+	Deregister        bool `json:"deregister"`
+	BeforeDrain       bool `json:"before_drain"`
+}
+
+// ServerConfig is the configuration of a server in ContConfig
+type ServerConfig struct {
+	Name          string   `json:"name"`
+	Network       string   `json:"network,omitempty"`
+	Address       string   `json:"address,omitempty"`
+	TLS           bool     `json:"tls"`
+	ProxyProtocol bool     `json:"proxy_protocol"`
+	Restart       string   `json:"restart"`
+	Lazy          bool     `json:"lazy"`
+	Optional      bool     `json:"optional"`
+	Worker        bool     `json:"worker"`
+	Inherit       bool     `json:"inherit"`
+	DependsOn     []string `json:"depends_on,omitempty"`
+
+	Sockopts SocketOptions `json:"sockopts"`
+}
+
+// Config returns the effective configuration of Cont
+func (cont *Cont) Config() ContConfig {
+	cfg := ContConfig{
+		ProcName:               cont.name,
+		WorkDir:                cont.cwd,
+		PidFile:                cont.pidfile,
+		Executable:             cont.exe,
+		LogLevel:               cont.logLevel().String(),
+		DrainTimeout:           cont.drainTimeout,
+		UpgradeTimeout:         cont.upgradeTimeout,
+		UpgradeDrainTimeout:    cont.upgradeDrain,
+		UpgradeWorkDir:         cont.upgradeDir,
+		SigtermGraceful:        cont.sigtermGrace,
+		UpgradeLimit:           cont.upgradeLimit,
+		UpgradeWindow:          cont.upgradeWindow,
+		MinUptimeBeforeUpgrade: cont.minUptime,
+		ConnStatsInterval:      cont.statsInterval,
+		ShutdownReportFile:     cont.reportFile,
+		DrainCompleteFile:      cont.drainFile,
+		WatchBinary:            cont.watchBinary,
+		AllowEmpty:             cont.allowEmpty,
+		JobControl:             cont.jobControl,
+		KeepGOMAXPROCS:         cont.keepProcs,
+		LogShutdownReport:      cont.logReport,
+		SerializeState:         cont.serializeState != nil,
+		Metrics:                cont.metrics != nil,
+		Warmup:                 cont.warmup != nil,
+		Deregister:             cont.onDeregister != nil,
+		BeforeDrain:            cont.beforeDrain != nil,
+	}
+	if cont.statusOn != nil {
+		cfg.StatusServer = cont.statusOn.Network + "://" + cont.statusOn.Address
+	}
+	for _, step := range cont.ladder {
+		cfg.ShutdownLadder = append(cfg.ShutdownLadder, step.Stage.String()+" "+step.Wait.String())
+	}
+	for sig := range cont.ignored {
+		cfg.IgnoredSignals = append(cfg.IgnoredSignals, sig.String())
+	}
+
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	for _, server := range cont.servers {
+		sc := ServerConfig{
+			Name:          server.name,
+			TLS:           server.tlsConfig != nil,
+			ProxyProtocol: server.proxyProto,
+			Restart:       server.restart.String(),
+			Lazy:          server.lazy,
+			Optional:      server.optional,
+			Worker:        server.worker,
+			Inherit:       !server.noInherit,
+			DependsOn:     server.dependsOn,
+			Sockopts:      server.sockopts,
+		}
+		if server.listenOn != nil {
+			sc.Network, sc.Address = server.listenOn.Network, server.listenOn.Address
+		}
+		cfg.Servers = append(cfg.Servers, sc)
+	}
+	return cfg
+}
+
+// logLevel finds the lowest level enabled by the logger
+func (cont *Cont) logLevel() zapcore.Level {
+	core := cont.logger.Core()
+	for l := zapcore.DebugLevel; l < zapcore.FatalLevel; l++ {
+		if core.Enabled(l) {
+			return l
+		}
+	}
+	return zapcore.FatalLevel
+}
+
+func (cont *Cont) config(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cont.Config())
+}
@@ -0,0 +1,59 @@
+package continuous
+
+import (
+	"encoding/json"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	cont := newTestCont(t, ProcName("test"), WorkDir(dir), DrainTimeout(3*time.Second), UpgradeLimit(2, time.Minute),
+		IgnoreSignals(syscall.SIGINT), JobControl(true), StatusServer(&ListenOn{"tcp", "127.0.0.1:0"}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("api"), DependsOn("db"),
+		Restart(RestartRebind), InheritOnUpgrade(false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("db"), Lazy()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := cont.Config()
+	if cfg.ProcName != "test" || cfg.WorkDir != dir || cfg.PidFile != cont.pidfile || cfg.LogLevel != "info" ||
+		cfg.DrainTimeout != 3*time.Second || cfg.UpgradeLimit != 2 || cfg.UpgradeWindow != time.Minute ||
+		!cfg.JobControl || cfg.AllowEmpty || len(cfg.IgnoredSignals) != 1 || cfg.IgnoredSignals[0] != "interrupt" ||
+		cfg.StatusServer != "tcp://127.0.0.1:0" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Servers) != 2 {
+		t.Fatalf("config has servers %+v, want 2", cfg.Servers)
+	}
+	api, db := cfg.Servers[0], cfg.Servers[1]
+	if api.Name != "api" || api.Address != "127.0.0.1:0" || api.Restart != RestartRebind.String() || api.Inherit ||
+		len(api.DependsOn) != 1 || api.DependsOn[0] != "db" || api.Lazy {
+		t.Fatalf("unexpected config of api %+v", api)
+	}
+	if db.Name != "db" || !db.Lazy || !db.Inherit {
+		t.Fatalf("unexpected config of db %+v", db)
+	}
+
+	// the status server exposes the same config
+	if err := cont.startStatus(); err != nil {
+		t.Fatal(err)
+	}
+	defer cont.stopStatus()
+	resp, err := http.Get("http://" + cont.statusLis.Addr().String() + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var exported ContConfig
+	if err := json.NewDecoder(resp.Body).Decode(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.ProcName != "test" || len(exported.Servers) != 2 || exported.Servers[0].Name != "api" {
+		t.Fatalf("unexpected config exported %+v", exported)
+	}
+}
@@ -0,0 +1,127 @@
+package continuous
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connCounter counts the connections accepted by the listener of a server
+type connCounter struct {
+	accepted int64
+	closed   int64
+}
+
+func (c *connCounter) Accepted() int64 {
+	return atomic.LoadInt64(&c.accepted)
+}
+
+func (c *connCounter) Closed() int64 {
+	return atomic.LoadInt64(&c.closed)
+}
+
+// Active returns the count of connections which are not closed yet
+func (c *connCounter) Active() int64 {
+	return c.Accepted() - c.Closed()
+}
+
+// ConnStats logs the connections accepted and closed during every interval, and the active ones of each server
+func ConnStats(interval time.Duration) Option {
+	return func(cont *Cont) {
+		cont.statsInterval = interval
+	}
+}
+
+// logConnStats logs the connection stats every interval until stop is closed
+func (cont *Cont) logConnStats(stop chan struct{}) {
+	ticker := time.NewTicker(cont.statsInterval)
+	defer ticker.Stop()
+	last := make(map[*ContServer][2]int64)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, server := range cont.servers {
+			if server.worker {
+				continue
+			}
+			accepted, closed := server.conns.Accepted(), server.conns.Closed()
+			prev := last[server]
+			last[server] = [2]int64{accepted, closed}
+			cont.logger.Info("connection stats", zap.String("server", server.name),
+				zap.Int64("accepted", accepted-prev[0]), zap.Int64("closed", closed-prev[1]),
+				zap.Int64("active", accepted-closed))
+		}
+	}
+}
+
+// countListener counts the connections it accepts, and reports them to the metrics if set
+type countListener struct {
+	net.Listener
+	counter *connCounter
+	metrics Metrics
+	labels  Labels
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.counter.accepted, 1)
+	if l.metrics != nil {
+		l.metrics.ConnOpened(l.labels)
+	}
+	return &countConn{Conn: conn, lis: l}, nil
+}
+
+type countConn struct {
+	net.Conn
+	lis  *countListener
+	once sync.Once
+}
+
+func (c *countConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.lis.counter.closed, 1)
+		if c.lis.metrics != nil {
+			c.lis.metrics.ConnClosed(c.lis.labels)
+		}
+	})
+	return err
+}
+
+// NetConn returns the underlying connection
+func (c *countConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ReadFrom keeps the sendfile and splice of the tcp connection working through the wrapper
+func (c *countConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{c.Conn}, r)
+}
+
+// SyscallConn returns the raw connection of the underlying connection, e.g. to set the socket options
+func (c *countConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.New("connection does not expose the raw connection")
+}
+
+// writerOnly hides the ReadFrom of the writer, so io.Copy does not call back into it
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,94 @@
+package continuous
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCountConn(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	cl := &countListener{Listener: lis, counter: &connCounter{}}
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := cl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.counter.Active() != 1 {
+		t.Fatalf("active = %d, want 1", cl.counter.Active())
+	}
+	if _, ok := conn.(io.ReaderFrom); !ok {
+		t.Fatal("ReadFrom of the tcp connection is hidden")
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		t.Fatal("SyscallConn of the tcp connection is hidden")
+	}
+	if _, err := sc.SyscallConn(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+	conn.Close()
+	if cl.counter.Closed() != 1 || cl.counter.Active() != 0 {
+		t.Fatalf("closed = %d, active = %d, want 1 and 0", cl.counter.Closed(), cl.counter.Active())
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	w := &syncWriter{}
+	cont := newTestCont(t, LoggerOutput(w), ConnStats(50*time.Millisecond))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("stats")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	conn, err := net.Dial("tcp", cont.servers[0].addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for i := 0; cont.servers[0].conns.Closed() != 1; i++ {
+		if i == 100 {
+			t.Fatal("connection is not closed by the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop, returned := make(chan struct{}), make(chan struct{})
+	go func() {
+		cont.logConnStats(stop)
+		close(returned)
+	}()
+	want := `"msg":"connection stats","server":"stats","accepted":1,"closed":1,"active":0`
+	for i := 0; ; i++ {
+		w.mu.Lock()
+		logs := w.logs.String()
+		w.mu.Unlock()
+		if strings.Contains(logs, want) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("no stats line %s in %s", want, logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("stats are logged after stop")
+	}
+}
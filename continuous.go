@@ -1,21 +1,63 @@
 package continuous
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	gnet "github.com/facebookgo/grace/gracenet"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// ErrServerExited is returned by Serve when a server with the ShutdownOnExit policy exits on its own
+var ErrServerExited = errors.New("server exited unexpectedly")
+
+// ErrTooManyUpgrades is returned when upgrades are refused by the limit set with UpgradeLimit
+var ErrTooManyUpgrades = errors.New("too many upgrades")
+
+// ErrChildNotReady is returned when the upgraded child is not ready within the UpgradeTimeout
+var ErrChildNotReady = errors.New("child process is not ready")
+
+// ErrNoServers is returned by Serve when no server is added
+var ErrNoServers = errors.New("no servers")
+
+// ErrUnknownServer is returned when no server has the given name
+var ErrUnknownServer = errors.New("unknown server")
+
+// ErrChildExited is returned when the upgraded child exits before it is ready
+var ErrChildExited = errors.New("child process exited")
+
+// ErrListenTimeout is returned when binding a listener is not finished within the ListenTimeout
+var ErrListenTimeout = errors.New("listen timeout")
+
+// ErrUpgradeTooEarly is returned when an upgrade is requested before the MinUptimeBeforeUpgrade
+var ErrUpgradeTooEarly = errors.New("upgrade too early")
+
+// ErrNotRunning is returned by Reload when Cont is not serving, e.g. paused or stopping
+var ErrNotRunning = errors.New("not running")
+
+// restartDelay is the interval between two restarts of a server
+const restartDelay = time.Second
+
+// childProbeDelay is the time to wait before checking the child is still alive after it is started
+const childProbeDelay = 100 * time.Millisecond
+
+// childStopTimeout is the time to wait for the child to exit after signaling it
+const childStopTimeout = 5 * time.Second
+
 // Continuous is the interface of a basic server
 type Continuous interface {
 	Serve(lis net.Listener) error
@@ -25,17 +67,89 @@ type Continuous interface {
 
 // Cont keeps your server which implement the Continuous continuously
 type Cont struct {
-	net      gnet.Net
+	net      *gnet.Net
 	name     string
 	pid      int
 	child    int
 	pidfile  string
+	wd       string // the work dir when started
+	exe      string // the absolute path of the executable
+	pids     PidStore
 	cwd      string
 	logger   *zap.Logger
 	servers  []*ContServer
 	state    ContState
 	wg       sync.WaitGroup
+	serveMu  sync.Mutex // orders starting to serve with closing doneChan
 	doneChan chan struct{}
+	stopping chan struct{} // closed when stopping, but not when pausing
+	workerWg sync.WaitGroup
+	exited   chan error
+	onListen func(lo *ListenOn, addr net.Addr)
+
+	upgradeLimit   int
+	upgradeWindow  time.Duration
+	upgrades       []time.Time
+	onUpgradeLimit func(count int, window time.Duration)
+	upgradeTimeout time.Duration
+	minUptime      time.Duration
+	started        time.Time
+
+	mu            sync.Mutex // protects state
+	eventsMu      sync.Mutex
+	subscribers   []chan Event
+	eventBuffer   int
+	backpressure  Backpressure
+	inherited     []string // addresses of the listeners inherited from the parent
+	drainTimeout  time.Duration
+	logReport     bool
+	reportFile    string
+	drainFile     string
+	ladder        []LadderStep
+	trackMu       sync.Mutex
+	tracked       int        // the count of the tracked work, protected by trackMu
+	trackIdle     *sync.Cond // broadcast when tracked drops to zero
+	watchBinary   bool
+	allowEmpty    bool
+	jobControl    bool
+	ignored       map[os.Signal]bool
+	triggers      chan os.Signal // signals raised internally, e.g. by the binary watcher
+	signalSource  <-chan os.Signal
+	statusOn      *ListenOn
+	statusLis     net.Listener
+	status        *http.Server
+	probeMu       sync.Mutex
+	probe         chan struct{} // closed once the state lock is taken by the pending liveness probe
+	statsInterval time.Duration
+	metrics       Metrics
+	afterBind     func() error
+	warmup        func() error
+	onStartup     func(results []ListenResult) error
+	startup       []ListenResult
+	listenTimeout time.Duration
+	stuckBinds    int32 // the count of the timed-out binds not returned yet, accessed atomically
+	backedUp      bool  // the pid is moved aside by the upgrade, so it can be restored
+	noPid         bool  // no pid is stored, set by Minimal unless a PidFile or PidBackend follows
+
+	serializeState func() (string, error)
+	inheritedState string
+	keepProcs      bool
+	upgraded       bool
+	onProcessStart func(upgraded bool) error
+	beforeUpgrade  func() error
+	afterUpgrade   func(err error)
+	upgradeDrain   time.Duration
+	upgradeDir     string
+	sigtermGrace   time.Duration
+	onDeregister   func(ctx context.Context) error
+	deregisterOnce sync.Once
+	beforeDrain    func(ctx context.Context) error
+	resignTimeout  time.Duration
+	resignOnce     sync.Once
+	group          *Group
+	cause          ShutdownCause
+	exitCode       func(cause ShutdownCause) int
+	exit           func(code int)
 }
 
 // ContState indicates the state of Cont
@@ -45,6 +159,8 @@ const (
 	Running ContState = iota
 	Ready
 	Stopped
+	Starting // not serving yet
+	Draining // stopping gracefully
 )
 
 func (cs ContState) String() string {
@@ -55,6 +171,40 @@ func (cs ContState) String() string {
 		return "stopped"
 	case Ready:
 		return "ready"
+	case Starting:
+		return "starting"
+	case Draining:
+		return "draining"
+	}
+	return ""
+}
+
+// RestartPolicy decides what to do when a server exits while no shutdown is in progress
+type RestartPolicy int
+
+const (
+	// RestartNever logs a warning and leaves the listener without a server
+	RestartNever RestartPolicy = iota
+	// RestartAlways serves the listener again
+	RestartAlways
+	// ShutdownOnExit stops all the servers gracefully and makes Serve return ErrServerExited
+	ShutdownOnExit
+	// RestartRebind is like RestartAlways, besides the listener is created again on the same address
+	// if the server exits because the listener is dead, e.g. its file descriptor becomes invalid.
+	// The servers without a ListenOn are served again like RestartAlways, and the workers can not use it
+	RestartRebind
+)
+
+func (rp RestartPolicy) String() string {
+	switch rp {
+	case RestartNever:
+		return "never"
+	case RestartAlways:
+		return "always"
+	case ShutdownOnExit:
+		return "shutdown"
+	case RestartRebind:
+		return "rebind"
 	}
 	return ""
 }
@@ -67,11 +217,26 @@ type ListenOn struct {
 
 // ContServer combines listener, addresss and a continuous
 type ContServer struct {
-	lis       net.Listener
-	srv       Continuous
-	listenOn  *ListenOn
-	tlsConfig *tls.Config
-	upgrader  func(lis net.Listener) net.Listener
+	name       string
+	dependsOn  []string
+	lis        net.Listener
+	raw        net.Listener // the listener bound by gracenet
+	addr       net.Addr     // the resolved address of the listener
+	srv        Continuous
+	listenOn   *ListenOn
+	tlsConfig  *tls.Config
+	upgrader   func(lis net.Listener) net.Listener
+	proxyProto bool // the PROXY protocol header is parsed beneath the TLSConfig
+	restart    RestartPolicy
+	fastOpen   int
+	lazy       bool
+	worker     bool
+	noInherit  bool
+	dropped    bool // the listener is closed when upgrading because it is not inherited, protected by serveMu
+	serving    bool // the server has started serving, protected by serveMu
+	sockopts   SocketOptions
+	optional   bool
+	conns      *connCounter
 }
 
 // Option to new a Cont
@@ -107,13 +272,160 @@ func LoggerOutput(out io.Writer) Option {
 func PidFile(filename string) Option {
 	return func(cont *Cont) {
 		cont.pidfile = filename
+		cont.noPid = false
+	}
+}
+
+// OnListen sets a callback which is called every time a listener of a server is bound
+// addr is the resolved address, for example the real port when listening on ":0"
+func OnListen(fn func(lo *ListenOn, addr net.Addr)) Option {
+	return func(cont *Cont) {
+		cont.onListen = fn
+	}
+}
+
+// UpgradeLimit refuses to upgrade when there were already n upgrades within the window
+// it prevents upgrade storms caused by signals sent repeatedly
+func UpgradeLimit(n int, window time.Duration) Option {
+	return func(cont *Cont) {
+		cont.upgradeLimit = n
+		cont.upgradeWindow = window
+	}
+}
+
+// OnUpgradeLimit sets a callback which is called when an upgrade is refused by UpgradeLimit
+func OnUpgradeLimit(fn func(count int, window time.Duration)) Option {
+	return func(cont *Cont) {
+		cont.onUpgradeLimit = fn
+	}
+}
+
+// UpgradeTimeout waits for the upgraded child to be ready within d, which means it has written its pid to the pid file.
+// If it is not ready in time, the child is stopped and the upgrade fails. The readiness is not checked if not set
+func UpgradeTimeout(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.upgradeTimeout = d
+	}
+}
+
+// MinUptimeBeforeUpgrade refuses the upgrades requested before the process has been up for d,
+// so a freshly started child does not upgrade again immediately
+func MinUptimeBeforeUpgrade(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.minUptime = d
+	}
+}
+
+// AllowEmpty allows serving without any server, for example the servers are added dynamically later
+func AllowEmpty(allow bool) Option {
+	return func(cont *Cont) {
+		cont.allowEmpty = allow
+	}
+}
+
+// JobControl pauses accepting connections on SIGTSTP and resumes on SIGCONT like toggling by SIGUSR1.
+// The process is not suspended by SIGTSTP anymore, so it interferes with the job control of shells
+func JobControl(enable bool) Option {
+	return func(cont *Cont) {
+		cont.jobControl = enable
+	}
+}
+
+// AfterBind sets a function which is called by Serve after all the listeners are bound but before serving,
+// Serve fails if it returns an error. It is the place to drop privileges after binding privileged ports.
+// Notice that before Go 1.16 syscall.Setuid and syscall.Setgid only change the calling thread on linux,
+// the other threads of the runtime keep the privileges, use a newer Go or drop privileges by the supervisor
+func AfterBind(fn func() error) Option {
+	return func(cont *Cont) {
+		cont.afterBind = fn
+	}
+}
+
+// ListenResult is the result of binding the listener of a server
+type ListenResult struct {
+	Name     string
+	Network  string
+	Address  string
+	Addr     net.Addr // the bound address, nil if it failed
+	Optional bool
+	Err      error
+}
+
+// OnStartup sets a function which is called by Serve with the results of binding the listeners of the servers added,
+// except the lazy ones, before AfterBind. Serve fails if it returns an error, e.g. to require some of the optional servers
+func OnStartup(fn func(results []ListenResult) error) Option {
+	return func(cont *Cont) {
+		cont.onStartup = fn
+	}
+}
+
+// Warmup sets a function which is called by Serve after AfterBind but before serving, for the expensive initialization
+// like loading models or warming caches. The listeners are bound but not accepting, so the connections wait in the backlog,
+// and the status server reports not ready until it returns. Serve fails if it returns an error, the signals delivered
+// during the warm-up are handled after it
+func Warmup(fn func() error) Option {
+	return func(cont *Cont) {
+		cont.warmup = fn
+	}
+}
+
+// ListenTimeout fails binding a listener with ErrListenTimeout if it is not finished within d, instead of
+// hanging the startup, e.g. the directory of a unix socket is on a stuck file system. Not bounded if not set.
+// gracenet is locked while a listen is stuck, so the other binds fail with ErrListenTimeout at once until it returns
+func ListenTimeout(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.listenTimeout = d
+	}
+}
+
+// SignalSource makes Serve receive the signals from c instead of the os, for example to feed synthetic
+// signals in tests. The signals are not registered by signal.Notify then, IgnoreSignals has no effect
+func SignalSource(c <-chan os.Signal) Option {
+	return func(cont *Cont) {
+		cont.signalSource = c
+	}
+}
+
+// SigtermGraceful stops the servers gracefully on SIGTERM instead of stopping them immediately, the drain is bounded by d.
+// For example on kubernetes, set d a little shorter than the terminationGracePeriodSeconds, so the process exits cleanly
+// before it is killed
+func SigtermGraceful(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.sigtermGrace = d
+	}
+}
+
+// Minimal discards the logs, stores no pid and serves no status server, so the overhead of the serving and upgrading
+// machinery can be measured without the I/O, e.g. in benchmarks. The options after it can enable them again.
+// No pid tells the readiness of the child then, with UpgradeTimeout it is ready once it keeps running for the timeout
+func Minimal() Option {
+	return func(cont *Cont) {
+		cont.logger = zap.NewNop()
+		cont.noPid = true
+		cont.statusOn = nil
+	}
+}
+
+// IgnoreSignals does not handle the signals, they keep the default behavior or are handled by the host application.
+// For example the host handles SIGTERM and SIGINT itself and calls Stop or GracefulStop
+func IgnoreSignals(sigs ...os.Signal) Option {
+	return func(cont *Cont) {
+		if cont.ignored == nil {
+			cont.ignored = make(map[os.Signal]bool)
+		}
+		for _, sig := range sigs {
+			cont.ignored[sig] = true
+		}
 	}
 }
 
 // New creates a Cont object which upgrades binary continuously
 func New(opts ...Option) *Cont {
 	dir, _ := os.Getwd()
-	cont := &Cont{name: os.Args[0], cwd: dir, pid: os.Getpid()}
+	cont := &Cont{net: &gnet.Net{}, name: os.Args[0], cwd: dir, pid: os.Getpid(), exited: make(chan error, 1),
+		triggers: make(chan os.Signal, 1), stopping: make(chan struct{}), state: Starting,
+		started: time.Now()}
+	cont.trackIdle = sync.NewCond(&cont.trackMu)
 	logger, err := zap.NewProduction(zap.AddCaller())
 	if err != nil {
 		fmt.Println(err)
@@ -125,10 +437,36 @@ func New(opts ...Option) *Cont {
 	for _, o := range opts {
 		o(cont)
 	}
+	cont.wd = dir
+	cont.inheritedState = os.Getenv(envState)
+	cont.upgraded = os.Getenv(envListenFds) != ""
+	if cont.exe, err = executable(); err != nil {
+		cont.logger.Error("resolve executable failed", zap.Error(err))
+	}
+	if cont.inherited, err = inheritedAddrs(); err != nil {
+		cont.logger.Warn("inspect inherited listeners failed", zap.Error(err))
+	}
 
 	if cont.pidfile == "" {
 		cont.pidfile = cont.cwd + "/" + cont.name + ".pid"
 	}
+	// the files stay where they are configured even if the working directory changes, e.g. by UpgradeWorkDir
+	for _, path := range []*string{&cont.pidfile, &cont.reportFile, &cont.drainFile} {
+		if *path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(*path); err != nil {
+			cont.logger.Warn("resolve absolute path failed", zap.Error(err), zap.String("path", *path))
+		} else {
+			*path = abs
+		}
+	}
+	if cont.pids == nil && cont.noPid {
+		cont.pids = nopPidStore{}
+	}
+	if cont.pids == nil {
+		cont.pids = &filePidStore{path: cont.pidfile}
+	}
 
 	return cont
 }
@@ -141,76 +479,398 @@ func TLSConfig(c *tls.Config) ServerOption {
 	}
 }
 
-// ListenerUpgrader upgrade a raw listener to a higher level listener
+// ListenerUpgrader upgrade a raw listener to a higher level listener, it is applied above the TLSConfig,
+// so the upgraded listener accepts the TLS connections
 func ListenerUpgrader(upgrader func(lis net.Listener) net.Listener) ServerOption {
 	return func(cs *ContServer) {
 		cs.upgrader = upgrader
 	}
 }
 
+// Restart sets the policy applied when the server exits on its own, RestartNever by default
+func Restart(policy RestartPolicy) ServerOption {
+	return func(cs *ContServer) {
+		cs.restart = policy
+	}
+}
+
+// FastOpen enables TCP Fast Open on the listener with the queue length qlen, it only works on linux and is ignored
+// for non-tcp listeners, a warning is logged on other platforms. The option is set on the socket after it is bound
+// by gracenet, which is already listening then, so it applies to the SYNs arriving afterwards
+func FastOpen(qlen int) ServerOption {
+	return func(cs *ContServer) {
+		cs.fastOpen = qlen
+	}
+}
+
+// Sockopts sets the socket options of the listener, they can be changed by Reload later
+func Sockopts(so SocketOptions) ServerOption {
+	return func(cs *ContServer) {
+		cs.sockopts = so
+	}
+}
+
+// ServerName names the server so other servers can depend on it, the address it listens on by default
+func ServerName(name string) ServerOption {
+	return func(cs *ContServer) {
+		cs.name = name
+	}
+}
+
+// DependsOn declares the names of the servers this server depends on, GracefulStop stops
+// this server before them
+func DependsOn(names ...string) ServerOption {
+	return func(cs *ContServer) {
+		cs.dependsOn = append(cs.dependsOn, names...)
+	}
+}
+
+// Lazy delays binding the listener of the server until it is activated by Cont.Activate.
+// Only the bound listeners are passed to the child when upgrading, so a lazy server is inactive
+// in the child until it is activated there again
+func Lazy() ServerOption {
+	return func(cs *ContServer) {
+		cs.lazy = true
+	}
+}
+
+// Optional does not fail AddServer if the listener can not be bound, the server is added without serving and
+// can be activated by Cont.Activate later. The failure is reported to the OnStartup callback
+func Optional() ServerOption {
+	return func(cs *ContServer) {
+		cs.optional = true
+	}
+}
+
+// InheritOnUpgrade decides whether the listener is passed to the child when upgrading, true by default.
+// A listener which is not inherited is closed once the child is started(or ready with UpgradeTimeout), so the endpoint
+// is dropped. It keeps serving if the upgrade fails
+func InheritOnUpgrade(inherit bool) ServerOption {
+	return func(cs *ContServer) {
+		cs.noInherit = !inherit
+	}
+}
+
 // AddServer and a server which implement Continuous interface
 // the added server will start to listen to the socket, but it only accept connections after serving
 func (cont *Cont) AddServer(srv Continuous, listenOn *ListenOn, opts ...ServerOption) error {
-	cs := &ContServer{srv: srv, listenOn: listenOn}
+	cs := &ContServer{srv: srv, listenOn: listenOn, name: listenOn.Address, conns: &connCounter{}}
 	for _, o := range opts {
 		o(cs)
 	}
-	lis, err := cont.net.Listen(listenOn.Network, listenOn.Address)
+	if !cs.lazy {
+		err := cont.listen(cs)
+		cont.startup = append(cont.startup, ListenResult{Name: cs.name, Network: listenOn.Network,
+			Address: listenOn.Address, Addr: cs.addr, Optional: cs.optional, Err: err})
+		if err == nil {
+			cont.notifyListen(cs)
+		}
+		if err != nil && !cs.optional {
+			return err
+		}
+		if err != nil {
+			// it is kept unbound, and can be bound by Activate later
+			cont.logger.Warn("optional server failed to listen", zap.Error(err), zap.String("server", cs.name))
+		}
+	}
+	cont.servers = append(cont.servers, cs)
+	return nil
+}
+
+// Server returns the server with the name, nil if no one has the name
+func (cont *Cont) Server(name string) *ContServer {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	for _, server := range cont.servers {
+		if server.name == name {
+			return server
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the server
+func (cs *ContServer) Name() string {
+	return cs.name
+}
+
+// Addr returns the address the listener is bound to, nil if it is not bound
+func (cs *ContServer) Addr() net.Addr {
+	return cs.addr
+}
+
+// SyscallConn returns the raw connection of the listener, e.g. to attach an eBPF program or inspect the socket options.
+// The file descriptor is owned by the listener and must not be closed
+func (cs *ContServer) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := cs.raw.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("listener does not expose the raw connection")
+	}
+	return sc.SyscallConn()
+}
+
+// File returns a duplicate of the file descriptor of the listener, e.g. to hand it to a sidecar. The caller should
+// close the file, which does not affect the listener, but the socket stays open until both are closed
+func (cs *ContServer) File() (*os.File, error) {
+	f, ok := cs.raw.(filer)
+	if !ok {
+		return nil, errors.New("listener does not expose the file")
+	}
+	return f.File()
+}
+
+// Activate binds the listener of a lazy server with the name and starts serving it if Cont is running.
+// It is a no-op if the listener has already been bound. Activate should not be called while pausing or resuming by SIGUSR1
+func (cont *Cont) Activate(name string) error {
+	server, err := cont.activate(name)
+	if server != nil {
+		cont.notifyListen(server)
+	}
+	return err
+}
+
+// activate binds and serves the lazy server with mu held, it returns the server if it is bound
+func (cont *Cont) activate(name string) (*ContServer, error) {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	for _, server := range cont.servers {
+		if server.name != name {
+			continue
+		}
+		if cont.listener(server) != nil || server.worker {
+			return nil, nil
+		}
+		if err := cont.listen(server); err != nil {
+			return nil, err
+		}
+		cont.logger.Info("server activated", zap.String("server", name), zap.Stringer("addr", server.addr))
+		if cont.state == Running && cont.doneChan != nil {
+			cont.serveServer(server)
+		}
+		return server, nil
+	}
+	return nil, ErrUnknownServer
+}
+
+// listen binds the listener of a server and wraps it with tls and the upgrader
+func (cont *Cont) listen(cs *ContServer) error {
+	lis, err := cont.bind(cs.listenOn.Network, cs.listenOn.Address)
 	if err != nil {
 		return err
 	}
+	cont.setup(cs, lis)
+	return nil
+}
+
+// notifyListen calls the OnListen callback with the bound address of the server. It is called without mu held,
+// so the callback can call the methods of Cont like Status
+func (cont *Cont) notifyListen(cs *ContServer) {
+	if cont.onListen == nil {
+		return
+	}
+	cont.mu.Lock()
+	addr := cs.addr
+	cont.mu.Unlock()
+	cont.onListen(cs.listenOn, addr)
+}
+
+// setup applies the socket options to the bound listener and wraps it to be served
+func (cont *Cont) setup(cs *ContServer, lis net.Listener) {
+	cont.applySockopts(cs, lis)
+	if cs.fastOpen > 0 && isTCP(cs.listenOn.Network) {
+		if err := control(lis, func(fd uintptr) error {
+			return setFastOpen(fd, cs.fastOpen)
+		}); err != nil {
+			cont.logger.Warn("enable tcp fast open failed", zap.Error(err), zap.String("listen", cs.listenOn.Address))
+		}
+	}
+	cs.raw, cs.addr = lis, lis.Addr()
+	if cs.sockopts.KeepAlive != 0 && isTCP(cs.listenOn.Network) {
+		lis = &keepAliveListener{Listener: lis, period: cs.sockopts.KeepAlive}
+	}
+	lis = &countListener{Listener: lis, counter: cs.conns, metrics: cont.metrics, labels: cs.labels()}
+	if cs.proxyProto {
+		lis = ProxyProtoListener(lis)
+	}
 	if cs.tlsConfig != nil {
 		lis = tls.NewListener(lis, cs.tlsConfig)
 	}
 	if cs.upgrader != nil {
 		lis = cs.upgrader(lis)
 	}
+	cont.serveMu.Lock()
 	cs.lis = lis
-	cont.servers = append(cont.servers, cs)
-	return nil
+	cont.serveMu.Unlock()
+}
+
+// bind listens on the address, bounded by the ListenTimeout
+func (cont *Cont) bind(network, address string) (net.Listener, error) {
+	if cont.listenTimeout <= 0 {
+		return cont.net.Listen(network, address)
+	}
+
+	type result struct {
+		lis net.Listener
+		err error
+	}
+	// listening while gracenet is locked by the stuck one would hang beyond the timeout
+	if atomic.LoadInt32(&cont.stuckBinds) > 0 {
+		cont.logger.Error("a previous listen is still stuck", zap.String("network", network), zap.String("address", address))
+		return nil, ErrListenTimeout
+	}
+	ch := make(chan result, 1)
+	go func() {
+		lis, err := cont.net.Listen(network, address)
+		ch <- result{lis, err}
+	}()
+	timer := time.NewTimer(cont.listenTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.lis, r.err
+	case <-timer.C:
+		// the stuck listen may finish later, nobody uses the listener then
+		atomic.AddInt32(&cont.stuckBinds, 1)
+		go func() {
+			if r := <-ch; r.lis != nil {
+				r.lis.Close()
+			}
+			atomic.AddInt32(&cont.stuckBinds, -1)
+		}()
+		cont.logger.Error("listen timeout", zap.String("network", network), zap.String("address", address))
+		return nil, ErrListenTimeout
+	}
 }
 
 // Serve run all the servers and wait to handle signals
 func (cont *Cont) Serve() error {
+	return cont.Run(context.Background())
+}
+
+// Run is like Serve, besides it stops the servers gracefully and returns nil when ctx is done.
+// It is designed to be a function of errgroup.Group, so a failure of any other member shuts cont down
+//
+//	g, ctx := errgroup.WithContext(context.Background())
+//	g.Go(func() error { return cont.Run(ctx) })
+func (cont *Cont) Run(ctx context.Context) error {
+	// flush the buffered logs at last, so the diagnostics of shutdown are not lost
+	defer cont.logger.Sync()
 	cont.logger.Debug("continuous serving")
+	if len(cont.servers) == 0 && !cont.allowEmpty {
+		return ErrNoServers
+	}
+	// register the signals before starting anything, the signals delivered during the startup are buffered
+	// and handled by the loop, rather than killing the process by the default behavior
+	c := cont.signalSource
+	if c == nil {
+		sigs := cont.signals()
+		notified := make(chan os.Signal, len(sigs))
+		signal.Notify(notified, sigs...)
+		defer signal.Stop(notified)
+		c = notified
+	}
+
+	if cont.onProcessStart != nil {
+		if err := cont.onProcessStart(cont.upgraded); err != nil {
+			return err
+		}
+	}
+	cont.checkInherited()
 	if err := cont.writePid(); err != nil {
 		return err
 	}
+	defer func() {
+		if err := cont.pids.Remove(); err != nil {
+			cont.logger.Error("remove pid failed", zap.Error(err))
+		}
+	}()
+
+	if err := cont.startStatus(); err != nil {
+		return err
+	}
+	defer cont.stopStatus()
+
+	if cont.onStartup != nil {
+		if err := cont.onStartup(cont.startup); err != nil {
+			return err
+		}
+	}
+	if cont.afterBind != nil {
+		if err := cont.afterBind(); err != nil {
+			return err
+		}
+	}
+	if cont.warmup != nil {
+		begin := time.Now()
+		if err := cont.warmup(); err != nil {
+			cont.logger.Error("warm up failed", zap.Error(err))
+			return err
+		}
+		cont.logger.Info("warmed up", zap.Duration("duration", time.Since(begin)))
+	}
 
 	if err := cont.serve(); err != nil {
 		return err
 	}
+	cont.startWorkers()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGCHLD)
 	cont.logger.Debug("waiting for signals")
 
+	stop := make(chan struct{})
+	defer close(stop)
+	if cont.watchBinary {
+		go cont.watch(stop)
+	}
+	if cont.statsInterval > 0 {
+		go cont.logConnStats(stop)
+	}
+
 	for {
-		sig := <-c
+		var sig os.Signal
+		select {
+		case err := <-cont.exited:
+			cont.logger.Error("server exited, shutting down", zap.Error(err))
+			cont.cause = CauseServerExited
+			cont.GracefulStop()
+			return err
+		case <-ctx.Done():
+			cont.logger.Info("context done, shutting down", zap.Error(ctx.Err()))
+			cont.cause = CauseContext
+			cont.settleUpgrade()
+			return cont.GracefulStop()
+		case sig = <-c:
+		case sig = <-cont.triggers:
+		}
 		cont.logger.Info("got signal", zap.Stringer("value", sig))
 		switch sig {
 		case syscall.SIGTERM, syscall.SIGINT:
+			cont.cause = CauseSignal
+			received := time.Now()
+			cont.settleUpgrade()
+			// the deadline is counted from the receipt of SIGTERM, settling the upgrade takes a part of it
+			deadline := received.Add(cont.sigtermGrace)
+			if sig == syscall.SIGTERM && cont.sigtermGrace > 0 && time.Now().Before(deadline) {
+				if _, err := cont.gracefulStopReport(deadline); err != nil {
+					cont.logger.Error("graceful stop failed", zap.Error(err))
+				}
+				return nil
+			}
 			cont.Stop()
 			return nil
-		case syscall.SIGQUIT:
+		case syscall.SIGQUIT, sigGroupStop:
+			cont.cause = CauseSignal
+			cont.settleUpgrade()
 			cont.GracefulStop()
 			return nil
 		case syscall.SIGUSR1:
-			if cont.state == Running {
-				cont.state = Ready
-				cont.closeListeners()
-			} else if cont.state == Ready {
-				cont.wg.Wait() //wait server goroutines to exit
-				//listen and serve again
-				if err := cont.openListeners(); err != nil {
-					cont.logger.Error("open listeners failed", zap.Error(err))
-					continue
-				}
-				if err := cont.serve(); err != nil {
-					cont.logger.Error("start serve failed", zap.Error(err))
-					continue
-				}
-				cont.state = Running
+			cont.toggle()
+		case syscall.SIGTSTP:
+			if cont.Status() == Running {
+				cont.pause()
+			}
+		case syscall.SIGCONT:
+			if cont.Status() == Ready {
+				cont.resume()
 			}
 
 		case syscall.SIGUSR2:
@@ -223,12 +883,24 @@ func (cont *Cont) Serve() error {
 				cont.logger.Error("upgrade binary failed", zap.Error(err))
 				continue
 			}
-			if err := cont.GracefulStop(); err != nil {
+			if err := cont.stopUpgraded(); err != nil {
 				cont.logger.Error("upgrade binary failed", zap.Error(err))
 				continue
 			}
 			return nil
+		case sigTakenOver:
+			// the child of the group leader has taken over the listeners of this member
+			if err := cont.stopUpgraded(); err != nil {
+				cont.logger.Error("drain after the group upgrade failed", zap.Error(err))
+				continue
+			}
+			return nil
 		case syscall.SIGCHLD:
+			// no upgrade child is tracked, e.g. the signal is sent by hand or by a child of the application
+			if cont.child == 0 {
+				cont.logger.Debug("no child to wait")
+				continue
+			}
 			p, err := os.FindProcess(cont.child)
 			if err != nil {
 				cont.logger.Error("find process failed", zap.Error(err))
@@ -243,123 +915,579 @@ func (cont *Cont) Serve() error {
 				} else {
 					cont.logger.Error("child exited failed", zap.Stringer("status", status))
 				}
+				cont.emit(Event{Type: ChildExited})
+				cont.child = 0
 			}
 
-			// recover pidfile.old to pidfile
-			if err := os.Rename(cont.pidfile+".old", cont.pidfile); err != nil {
-				cont.logger.Error("recover pid file failed", zap.Error(err))
-			}
+			cont.recoverPid()
 		}
 	}
 }
 
 // Stop the server immediately
 func (cont *Cont) Stop() error {
-	if cont.doneChan != nil {
-		close(cont.doneChan)
-	}
+	cont.closeDone()
+	cont.closeStopping()
 	for _, server := range cont.servers {
 		if err := server.srv.Stop(); err != nil {
 			return err
 		}
 	}
-	cont.state = Stopped
+	// the workers may still be returning from Run, wait for them like a graceful stop
+	timeout := cont.drainTimeout
+	if timeout <= 0 {
+		timeout = forceStopTimeout
+	}
+	if !waitUntil(cont.workerWg.Wait, time.Now().Add(timeout)) {
+		cont.logger.Warn("workers are not stopped in time")
+	}
+	cont.setState(Stopped)
+	cont.stopStatus()
 	return nil
 }
 
 // GracefulStop the server
 func (cont *Cont) GracefulStop() error {
-	if cont.doneChan != nil {
-		close(cont.doneChan)
+	_, err := cont.GracefulStopReport()
+	return err
+}
+
+func (cont *Cont) upgrade() error {
+	cont.emit(Event{Type: UpgradeStarted})
+	err := cont.spawnWithHooks()
+	if err != nil {
+		cont.emit(Event{Type: UpgradeFailed, Err: err})
+		return err
 	}
-	for _, server := range cont.servers {
-		if err := server.srv.GracefulStop(); err != nil {
-			return err
+	cont.emit(Event{Type: UpgradeSucceeded})
+	return nil
+}
+
+// spawnWithHooks spawns the child between the BeforeUpgrade and AfterUpgrade, the hooks of all the members of the
+// group run, since the child takes over the listeners of them all
+func (cont *Cont) spawnWithHooks() error {
+	members := cont.members()
+	var err error
+	ran := 0
+	for _, m := range members {
+		if m.beforeUpgrade != nil {
+			if err = m.beforeUpgrade(); err != nil {
+				break
+			}
+		}
+		ran++
+	}
+	if err == nil {
+		err = cont.spawn()
+	}
+	for _, m := range members[:ran] {
+		if m.afterUpgrade != nil {
+			m.afterUpgrade(err)
 		}
 	}
-	cont.state = Stopped
+	return err
+}
+
+// stopUpgraded drains the servers after the child has taken over, bounded by the UpgradeDrainTimeout
+func (cont *Cont) stopUpgraded() error {
+	timeout := cont.drainTimeout
+	if cont.upgradeDrain > 0 {
+		timeout = cont.upgradeDrain
+	}
+	// the cause is known ahead of the drain, which skips the hooks not meant for an upgrade
+	cont.cause = CauseUpgraded
+	report, err := cont.gracefulStopReport(drainDeadline(timeout))
+	if err != nil {
+		return err
+	}
+	if report.Forced {
+		cont.logger.Warn("drain exceeded the timeout after upgrading, servers are stopped by force",
+			zap.Duration("duration", report.Duration))
+	}
 	return nil
 }
 
-func (cont *Cont) upgrade() error {
-	// rename pidfile to pidfile.old
-	if err := os.Rename(cont.pidfile, cont.pidfile+".old"); err != nil {
-		cont.logger.Warn("rename pid file failed", zap.Error(err))
+// spawn starts the child process which inherits the listeners
+func (cont *Cont) spawn() error {
+	if uptime := time.Since(cont.started); uptime < cont.minUptime {
+		cont.logger.Warn("upgrade refused, the process is not up long enough",
+			zap.Duration("uptime", uptime), zap.Duration("min", cont.minUptime))
+		return ErrUpgradeTooEarly
+	}
+	if err := cont.checkUpgradeLimit(); err != nil {
+		return err
+	}
+
+	// move the pid aside, e.g. rename pidfile to pidfile.old. The upgrade is aborted if it fails, otherwise
+	// the child overwrites the pid, and nothing could be restored if the child fails.
+	// A pid which does not exist, e.g. the pid file is removed by hand, leaves nothing to restore
+	err := cont.pids.Backup()
+	if err != nil && !os.IsNotExist(err) {
+		cont.logger.Error("backup pid failed", zap.Error(err))
+		return err
+	}
+	if err != nil && !cont.noPid {
+		cont.logger.Warn("no pid to backup", zap.Error(err))
 	}
+	cont.backedUp = err == nil
 
-	pid, err := cont.net.StartProcess()
+	pid, err := cont.startProcess()
 	if err != nil {
+		cont.recoverPid()
 		return err
 	}
 	cont.logger.Info("new process started", zap.Int("child", pid))
 	cont.child = pid
+	cont.emit(Event{Type: ChildSpawned})
+
+	// the child may fail before running any of our code, for example the exec fails
+	time.Sleep(childProbeDelay)
+	if cont.waitChild(0) {
+		cont.logger.Error("child process exited right after started", zap.Int("child", pid))
+		cont.recoverPid()
+		return ErrChildExited
+	}
+
+	if cont.upgradeTimeout > 0 {
+		if err := cont.waitChildReady(cont.upgradeTimeout); err != nil {
+			cont.logger.Error("child process is not ready", zap.Error(err), zap.Int("child", pid))
+			if cont.child != 0 {
+				cont.stopChild()
+			}
+			cont.recoverPid()
+			return err
+		}
+		cont.logger.Info("new process is ready", zap.Int("child", pid))
+	}
+	// the listeners not inherited are kept until now, so they keep serving if the upgrade fails
+	cont.dropNotInherited()
+	return nil
+}
+
+// settleUpgrade decides the owner of the listeners and the pid before stopping while a child is running:
+// the child takes over if it is ready within the UpgradeTimeout(childStopTimeout if not set), otherwise
+// the upgrade is aborted, the child is stopped and the pid is recovered, so no orphaned child is left
+func (cont *Cont) settleUpgrade() {
+	if cont.child == 0 {
+		return
+	}
+	timeout := cont.upgradeTimeout
+	if timeout <= 0 {
+		timeout = childStopTimeout
+	}
+	if err := cont.waitChildReady(timeout); err == nil {
+		cont.logger.Info("child has taken over", zap.Int("child", cont.child))
+		return
+	}
+	cont.logger.Warn("abort the upgrade in progress", zap.Int("child", cont.child))
+	if cont.child != 0 {
+		cont.stopChild()
+	}
+	cont.recoverPid()
+}
+
+// waitChildReady waits for the child to store its pid, or to keep running for the timeout if no pid is stored
+func (cont *Cont) waitChildReady(timeout time.Duration) error {
+	// the child stores no pid, surviving the timeout is the only sign of its readiness
+	storeless := cont.noPid
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if pid, err := cont.pids.Read(); err == nil && pid == cont.child && !storeless {
+			return nil
+		}
+		if cont.waitChild(0) {
+			return ErrChildExited
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if storeless {
+		return nil
+	}
+	return ErrChildNotReady
+}
+
+// stopChild stops the child gracefully and kills it if it is still running after childStopTimeout
+func (cont *Cont) stopChild() {
+	if err := cont.gracefulStopChild(); err != nil {
+		cont.logger.Error("graceful stop child failed", zap.Error(err), zap.Int("child", cont.child))
+	} else if cont.waitChild(childStopTimeout) {
+		return
+	}
+	if err := cont.forceStopChild(); err != nil {
+		cont.logger.Error("force stop child failed", zap.Error(err), zap.Int("child", cont.child))
+		return
+	}
+	cont.waitChild(childStopTimeout)
+}
+
+// gracefulStopChild sends SIGQUIT to the child
+func (cont *Cont) gracefulStopChild() error {
+	return cont.signalChild(syscall.SIGQUIT)
+}
+
+// forceStopChild sends SIGKILL to the child
+func (cont *Cont) forceStopChild() error {
+	return cont.signalChild(syscall.SIGKILL)
+}
+
+func (cont *Cont) signalChild(sig syscall.Signal) error {
+	if cont.child == 0 {
+		return errors.New("no child process")
+	}
+	cont.logger.Info("signal child", zap.Int("child", cont.child), zap.Stringer("signal", sig))
+	return syscall.Kill(cont.child, sig)
+}
+
+// waitChild reaps the child, it returns false if the child is still running after the timeout
+func (cont *Cont) waitChild(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(cont.child, &status, syscall.WNOHANG, nil)
+		if err != nil || pid == cont.child {
+			// ECHILD means the child has been reaped already
+			cont.logger.Info("child exited", zap.Int("child", cont.child), zap.Int("status", status.ExitStatus()))
+			cont.emit(Event{Type: ChildExited})
+			cont.child = 0
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// checkUpgradeLimit records an upgrade attempt, it fails if the attempts within the window exceed the limit
+func (cont *Cont) checkUpgradeLimit() error {
+	if cont.upgradeLimit <= 0 {
+		return nil
+	}
+	now := time.Now()
+	recent := cont.upgrades[:0]
+	for _, t := range cont.upgrades {
+		if now.Sub(t) < cont.upgradeWindow {
+			recent = append(recent, t)
+		}
+	}
+	cont.upgrades = recent
+
+	if len(cont.upgrades) >= cont.upgradeLimit {
+		cont.logger.Error("upgrade refused, too many upgrades", zap.Int("count", len(cont.upgrades)),
+			zap.Duration("window", cont.upgradeWindow))
+		if cont.onUpgradeLimit != nil {
+			cont.onUpgradeLimit(len(cont.upgrades), cont.upgradeWindow)
+		}
+		return ErrTooManyUpgrades
+	}
+	cont.upgrades = append(cont.upgrades, now)
 	return nil
 }
 
+// signals returns the signals to handle
+func (cont *Cont) signals() []os.Signal {
+	sigs := []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGCHLD}
+	if cont.jobControl {
+		sigs = append(sigs, syscall.SIGTSTP, syscall.SIGCONT)
+	}
+	handled := sigs[:0]
+	for _, sig := range sigs {
+		if !cont.ignored[sig] {
+			handled = append(handled, sig)
+		}
+	}
+	return handled
+}
+
+// toggle pauses a running Cont or resumes a paused one, it is a no-op in the other states,
+// e.g. the listeners are closed already when draining or stopped
+func (cont *Cont) toggle() {
+	switch state := cont.Status(); state {
+	case Running:
+		cont.pause()
+	case Ready:
+		cont.resume()
+	default:
+		cont.logger.Warn("can not pause or resume", zap.Stringer("state", state))
+	}
+}
+
+// pause stops accepting connections by closing the listeners
+func (cont *Cont) pause() {
+	cont.setState(Ready)
+	cont.closeListeners()
+}
+
+// resume listens and serves again after pause
+func (cont *Cont) resume() {
+	cont.wg.Wait() //wait server goroutines to exit
+	if err := cont.openListeners(); err != nil {
+		cont.logger.Error("open listeners failed", zap.Error(err))
+		return
+	}
+	if err := cont.serve(); err != nil {
+		cont.logger.Error("start serve failed", zap.Error(err))
+		return
+	}
+	cont.setState(Running)
+}
+
 func (cont *Cont) closeListeners() {
 	// close chan to notify Serve to exit and ignore
-	if cont.doneChan != nil {
-		close(cont.doneChan)
-	}
+	cont.closeDone()
 
 	for _, server := range cont.servers {
-		if err := server.lis.Close(); err != nil {
+		lis := cont.listener(server)
+		if lis == nil || cont.isDropped(server) {
+			continue
+		}
+		if err := lis.Close(); err != nil {
 			cont.logger.Error("close listener failed", zap.Error(err), zap.String("listenon", server.listenOn.Address))
 		}
 	}
-	// gracenet internal stores all the active listeners. When we close listeners here, we can not notify gracenet about this
-	// so it will keep those closed listeners and try to pass to child process which cause errors, so we reinit net here
-	cont.net = gnet.Net{}
+	// gracenet internal stores the inherited listeners and returns them when listening on the same addresses again,
+	// so we reinit net here to avoid getting those closed listeners
+	cont.net = &gnet.Net{}
 }
 
 func (cont *Cont) openListeners() error {
 	for _, server := range cont.servers {
-		lis, err := cont.net.Listen(server.listenOn.Network, server.listenOn.Address)
-		if err != nil {
-			return err
-		}
-		if server.upgrader != nil {
-			lis = server.upgrader(lis)
+		if cont.listener(server) == nil || cont.isDropped(server) {
+			continue
 		}
-		server.lis = lis
-		if server.tlsConfig != nil {
-			server.lis = tls.NewListener(lis, server.tlsConfig)
+		if err := cont.listen(server); err != nil {
+			return err
 		}
+		cont.notifyListen(server)
 	}
 	return nil
 }
 
+// closeDone notifies the serving goroutines that they are going to exit, it is safe to be called
+// more than once, for example stopping when the listeners are already closed by SIGUSR1
+func (cont *Cont) closeDone() {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	if cont.doneChan == nil {
+		return
+	}
+	select {
+	case <-cont.doneChan:
+	default:
+		close(cont.doneChan)
+	}
+}
+
+// closeStopping notifies the workers that the shutdown begins
+func (cont *Cont) closeStopping() {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	select {
+	case <-cont.stopping:
+	default:
+		close(cont.stopping)
+	}
+}
+
 func (cont *Cont) serve() error {
 	cont.doneChan = make(chan struct{})
 
 	for _, server := range cont.servers {
-		cont.wg.Add(1)
-		go func(server *ContServer) {
-			done := false
-			if err := server.srv.Serve(server.lis); err != nil {
-				select {
-				case <-cont.doneChan:
-					done = true // ignore error which caused by Stop/GracefulStop
-					cont.logger.Debug("serve close", zap.String("listen", server.listenOn.Address))
-				default:
-				}
-				if !done {
-					cont.logger.Error("serve failed", zap.Error(err), zap.String("listen", server.listenOn.Address))
+		// lazy servers are served once activated, workers are not affected by pausing and resuming
+		if cont.listener(server) != nil && !server.worker && !cont.isDropped(server) {
+			cont.serveServer(server)
+		}
+	}
+
+	cont.setState(Running)
+	return nil
+}
+
+// serveServer runs the server in a new goroutine
+func (cont *Cont) serveServer(server *ContServer) {
+	cont.wg.Add(1)
+	go cont.run(server, cont.doneChan, &cont.wg)
+}
+
+// run serves until done is closed, the server is restarted according to its RestartPolicy if it exits before
+func (cont *Cont) run(server *ContServer, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		if !cont.startServing(server, done) {
+			// stopped before serving, nobody else closes the listener then
+			if lis := cont.listener(server); lis != nil {
+				lis.Close()
+			}
+			return
+		}
+		lis := cont.listener(server)
+		err := server.srv.Serve(lis)
+		if cont.isDropped(server) {
+			cont.logger.Info("server is dropped by upgrading", zap.String("server", server.name))
+			return
+		}
+		select {
+		case <-done:
+			// ignore error which caused by Stop/GracefulStop
+			cont.logger.Debug("serve close", zap.String("server", server.name))
+			return
+		default:
+		}
+		if cont.listener(server) != lis {
+			cont.logger.Info("serve the reloaded listener", zap.String("server", server.name))
+			continue
+		}
+		if err != nil {
+			cont.logger.Error("serve failed", zap.Error(err), zap.String("server", server.name))
+		} else {
+			cont.logger.Warn("server exited without shutdown", zap.String("server", server.name),
+				zap.Stringer("restart", server.restart))
+		}
+
+		switch server.restart {
+		case RestartAlways, RestartRebind:
+			select {
+			case <-done:
+				return
+			case <-time.After(restartDelay):
+			}
+			if server.restart == RestartRebind && deadListener(err) && cont.canRebind(server) {
+				if err := cont.rebind(server); err != nil {
+					// serving the dead listener fails at once, so it is tried again after the delay
+					cont.logger.Error("rebind failed", zap.Error(err), zap.String("server", server.name))
 				}
 			}
-			cont.wg.Done()
-		}(server)
+			cont.logger.Info("restart server", zap.String("server", server.name))
+		case ShutdownOnExit:
+			select {
+			case cont.exited <- ErrServerExited:
+			default:
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+// deadListener reports whether err is returned by accepting on a listener which can not be used any more
+func deadListener(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
 	}
+	switch err {
+	case syscall.EBADF, syscall.EINVAL, syscall.ENOTSOCK:
+		return true
+	}
+	// the error of a closed listener is not exported by net before go1.16, it is matched by the message
+	return err != nil && strings.Contains(err.Error(), errListenerClosed.Error())
+}
+
+// canRebind reports whether the server listens on an address by itself, which can be listened on again
+func (cont *Cont) canRebind(server *ContServer) bool {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	return !server.worker && server.listenOn != nil && server.raw != nil
+}
 
-	cont.state = Running
+// rebind closes the dead listener of the server and listens on the same address again
+func (cont *Cont) rebind(server *ContServer) error {
+	cont.mu.Lock()
+	cont.logger.Warn("listener is dead, rebind", zap.String("server", server.name),
+		zap.String("listen", server.listenOn.Address))
+	server.raw.Close()
+	err := cont.listen(server)
+	cont.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	cont.notifyListen(server)
 	return nil
 }
 
+// startServing reports whether the server can start serving, it is false once the shutdown begins.
+// So after closeDone returns, a server either has started serving or never serves
+func (cont *Cont) startServing(server *ContServer, done chan struct{}) bool {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	select {
+	case <-done:
+		return false
+	default:
+		server.serving = true
+		return true
+	}
+}
+
+// hasServed reports whether the server has ever started serving
+func (cont *Cont) hasServed(server *ContServer) bool {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	return server.serving
+}
+
+// dropListener closes the listener which is not inherited by the child
+func (cont *Cont) dropListener(server *ContServer) {
+	cont.serveMu.Lock()
+	server.dropped = true
+	cont.serveMu.Unlock()
+	if err := cont.listener(server).Close(); err != nil {
+		cont.logger.Error("close listener failed", zap.Error(err), zap.String("server", server.name))
+	}
+}
+
+// listener returns the listener to be served, it is replaced by Reload
+func (cont *Cont) listener(server *ContServer) net.Listener {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	return server.lis
+}
+
+func (cont *Cont) isDropped(server *ContServer) bool {
+	cont.serveMu.Lock()
+	defer cont.serveMu.Unlock()
+	return server.dropped
+}
+
 func (cont *Cont) writePid() error {
-	return ioutil.WriteFile(cont.pidfile, []byte(fmt.Sprint(cont.pid)), 0644)
+	return cont.pids.Write(PidInfo{Pid: cont.pid, Start: cont.started, Executable: cont.exe})
+}
+
+// recoverPid moves the old pid back if it is still ours
+func (cont *Cont) recoverPid() {
+	if !cont.backedUp {
+		return
+	}
+	cont.backedUp = false
+	if pid, err := cont.pids.ReadOld(); err != nil {
+		cont.logger.Error("read old pid failed", zap.Error(err))
+	} else if pid != cont.pid {
+		cont.logger.Warn("old pid is not owned by this process", zap.Int("owner", pid))
+	} else if err := cont.pids.Restore(); err != nil {
+		cont.logger.Error("recover pid failed", zap.Error(err))
+	}
 }
 
 // Status return the current status
 func (cont *Cont) Status() ContState {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
 	return cont.state
 }
+
+// setState changes the state and emits a StateChanged event
+func (cont *Cont) setState(state ContState) {
+	cont.mu.Lock()
+	changed := cont.state != state
+	cont.state = state
+	cont.mu.Unlock()
+	if changed {
+		if cont.metrics != nil {
+			cont.metrics.StateChanged(state)
+		}
+		cont.emit(Event{Type: StateChanged})
+	}
+}
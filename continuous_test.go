@@ -0,0 +1,961 @@
+package continuous
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the test binary is started again as the upgrade child
+	if mode := os.Getenv(envTestChild); mode != "" {
+		os.Exit(testChild(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// newTestCont creates a Cont which logs nothing and keeps its pid file in a temp dir
+func newTestCont(t testing.TB, opts ...Option) *Cont {
+	opts = append([]Option{LoggerOutput(ioutil.Discard), PidFile(filepath.Join(t.TempDir(), "test.pid"))}, opts...)
+	return New(opts...)
+}
+
+// serveAsync runs Serve in a new goroutine and waits for cont to run
+func serveAsync(t testing.TB, cont *Cont) <-chan error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.Serve()
+	}()
+	if err := cont.WaitState(Running, 5*time.Second); err != nil {
+		t.Fatalf("cont is not running: %v", err)
+	}
+	return errc
+}
+
+// startServing serves the servers without handling signals, and waits for all of them to start serving
+func startServing(t testing.TB, cont *Cont) {
+	t.Helper()
+	if err := cont.serve(); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range cont.servers {
+		if server.worker || server.lis == nil {
+			continue
+		}
+		for i := 0; !cont.hasServed(server); i++ {
+			if i == 500 {
+				t.Fatalf("server %s does not serve", server.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// waitServe waits for Serve to return
+func waitServe(t testing.TB, errc <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve does not return")
+	}
+	return nil
+}
+
+// signals returns a channel to feed the signals by the SignalSource option
+func signals() (chan os.Signal, Option) {
+	c := make(chan os.Signal, 1)
+	return c, SignalSource(c)
+}
+
+// testCertificate creates a self-signed certificate for the names
+func testCertificate(t testing.TB, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestRestartRebind(t *testing.T) {
+	cont := newTestCont(t)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}, Restart(RestartRebind)); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	server := cont.servers[0]
+	dead := cont.listener(server)
+
+	// the listener dies beneath the server
+	server.raw.Close()
+	for i := 0; cont.listener(server) == dead; i++ {
+		if i == 300 {
+			t.Fatal("dead listener is not rebound")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cont.mu.Lock()
+	addr := server.addr.String()
+	cont.mu.Unlock()
+	for i := 0; ; i++ {
+		body, err := get(addr, "/")
+		if err == nil && body == "ok" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("rebound listener is not served: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenTimeoutStuck(t *testing.T) {
+	cont := newTestCont(t, ListenTimeout(time.Second))
+	// a previous listen is stuck with gracenet locked
+	atomic.AddInt32(&cont.stuckBinds, 1)
+	start := time.Now()
+	if _, err := cont.bind("tcp", "127.0.0.1:0"); err != ErrListenTimeout {
+		t.Fatalf("bind while a listen is stuck: %v, want ErrListenTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("bind fails after %v, want at once", elapsed)
+	}
+
+	atomic.AddInt32(&cont.stuckBinds, -1)
+	lis, err := cont.bind("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+}
+
+func TestMinimalUpgradeTimeout(t *testing.T) {
+	cont := newTestCont(t, Minimal(), UpgradeTimeout(500*time.Millisecond))
+	childMode(t, cont, "exit")
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+
+	// no pid is stored, the child keeps running for the timeout
+	childMode(t, cont, "stubborn")
+	start := time.Now()
+	if err := cont.spawn(); err != nil {
+		t.Fatalf("child is not ready without a pid: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("child is ready after %v, before the timeout", elapsed)
+	}
+}
+
+func BenchmarkServeStop(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sigc, source := signals()
+		cont := New(Minimal(), source)
+		if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			b.Fatal(err)
+		}
+		errc := serveAsync(b, cont)
+		sigc <- syscall.SIGTERM
+		if err := waitServe(b, errc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAbsolutePaths(t *testing.T) {
+	cont := New(LoggerOutput(ioutil.Discard), PidFile("test.pid"), ShutdownReportFile("report.json"),
+		DrainCompleteFile("drained"))
+	wd, _ := os.Getwd()
+	for path, want := range map[string]string{cont.pidfile: "test.pid", cont.reportFile: "report.json",
+		cont.drainFile: "drained"} {
+		if path != filepath.Join(wd, want) {
+			t.Fatalf("path %s is not resolved against the working directory %s", path, wd)
+		}
+	}
+}
+
+// slowServer serves every request for the duration
+func slowServer(d time.Duration) (*http.Server, chan struct{}) {
+	started := make(chan struct{}, 1)
+	return &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(d)
+		w.Write([]byte("done"))
+	})}, started
+}
+
+func TestSigtermGraceful(t *testing.T) {
+	srv, started := slowServer(300 * time.Millisecond)
+	sigc, source := signals()
+	cont := newTestCont(t, source, SigtermGraceful(2*time.Second))
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	done := make(chan error, 1)
+	go func() {
+		_, err := get(cont.servers[0].addr.String(), "/")
+		done <- err
+	}()
+	<-started
+
+	// SIGTERM drains rather than stops at once, the request in flight finishes
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("request is not drained on SIGTERM: %v", err)
+	}
+}
+
+func TestSigtermGracefulDeadline(t *testing.T) {
+	grace := 800 * time.Millisecond
+	srv, started := slowServer(time.Minute)
+	sigc, source := signals()
+	// the hook ignores its timeout, the deadline of SIGTERM bounds it as well
+	resign := BeforeDrain(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 5*time.Second)
+	cont := newTestCont(t, source, SigtermGraceful(grace), resign)
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	go get(cont.servers[0].addr.String(), "/")
+	<-started
+
+	received := time.Now()
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(received); elapsed > grace+300*time.Millisecond {
+		t.Fatalf("serve returns %v after SIGTERM, beyond the deadline %v", elapsed, grace)
+	}
+}
+
+// exitingServer returns from Serve without being stopped after the delay
+type exitingServer struct {
+	delay  time.Duration
+	serves int32
+}
+
+func (s *exitingServer) Serve(lis net.Listener) error {
+	atomic.AddInt32(&s.serves, 1)
+	time.Sleep(s.delay)
+	return nil
+}
+
+func (s *exitingServer) Stop() error         { return nil }
+func (s *exitingServer) GracefulStop() error { return nil }
+
+func (s *exitingServer) Serves() int {
+	return int(atomic.LoadInt32(&s.serves))
+}
+
+func TestServerExitedRestart(t *testing.T) {
+	never, always := &exitingServer{}, &exitingServer{}
+	cont := newTestCont(t)
+	if err := cont.AddServer(never, &ListenOn{"tcp", "127.0.0.1:0"}, Restart(RestartNever)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(always, &ListenOn{"tcp", "127.0.0.1:0"}, Restart(RestartAlways)); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+
+	for i := 0; always.Serves() < 2; i++ {
+		if i == 300 {
+			t.Fatal("exited server is not restarted with RestartAlways")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := never.Serves(); n != 1 {
+		t.Fatalf("server with RestartNever serves %d times, want once", n)
+	}
+}
+
+func TestServerExitedShutdown(t *testing.T) {
+	cont := newTestCont(t)
+	srv := &exitingServer{delay: 200 * time.Millisecond}
+	if err := cont.AddServer(srv, &ListenOn{"tcp", "127.0.0.1:0"}, Restart(ShutdownOnExit)); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	if err := waitServe(t, errc); err != ErrServerExited {
+		t.Fatalf("serve returns %v, want ErrServerExited", err)
+	}
+	if cause := cont.Cause(); cause != CauseServerExited {
+		t.Fatalf("cause is %s, want server exited", cause)
+	}
+}
+
+func TestOnListen(t *testing.T) {
+	listened := make(map[string]net.Addr)
+	cont := newTestCont(t, OnListen(func(lo *ListenOn, addr net.Addr) {
+		if _, ok := listened[lo.Address]; ok {
+			t.Errorf("callback fires again for %s", lo.Address)
+		}
+		listened[lo.Address] = addr
+	}))
+	for _, address := range []string{"127.0.0.1:0", "localhost:0"} {
+		if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(listened) != 2 {
+		t.Fatalf("callback fires for %d servers, want 2", len(listened))
+	}
+	for i, server := range cont.servers {
+		addr := listened[server.listenOn.Address]
+		if addr == nil || addr.String() != server.addr.String() || addr.(*net.TCPAddr).Port == 0 {
+			t.Fatalf("callback of server %d gets %v, want the resolved address %v", i, addr, server.addr)
+		}
+	}
+}
+
+func TestUpgradeLimit(t *testing.T) {
+	var refused int
+	cont := newTestCont(t, UpgradeLimit(2, time.Minute), OnUpgradeLimit(func(count int, window time.Duration) {
+		refused++
+	}))
+	childMode(t, cont, "exit")
+	for i := 0; i < 2; i++ {
+		if err := cont.spawn(); err != ErrChildExited {
+			t.Fatalf("upgrade %d returns %v, want ErrChildExited", i, err)
+		}
+	}
+	// the failed upgrades count as well, a storm of them trips the guard
+	for i := 0; i < 2; i++ {
+		if err := cont.spawn(); err != ErrTooManyUpgrades {
+			t.Fatalf("upgrade beyond the limit returns %v, want ErrTooManyUpgrades", err)
+		}
+	}
+	if refused != 2 {
+		t.Fatalf("limit hook is called %d times, want 2", refused)
+	}
+
+	// the upgrades out of the window are forgotten
+	cont.upgradeWindow = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("upgrade after the window returns %v, want ErrChildExited", err)
+	}
+}
+
+func TestRunSiblingFails(t *testing.T) {
+	srv := NewTestServer()
+	cont := newTestCont(t)
+	if err := cont.AddServer(srv, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// like errgroup.WithContext, the failure of a sibling cancels the context of the others
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.Run(ctx)
+	}()
+	if err := cont.WaitState(Running, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	if err := waitServe(t, errc); err != nil {
+		t.Fatalf("run returns %v after the context is done, want nil", err)
+	}
+	if cause := cont.Cause(); cause != CauseContext {
+		t.Fatalf("cause is %s, want context", cause)
+	}
+	if calls := fmt.Sprint(srv.Calls()); calls != "[Serve GracefulStop]" {
+		t.Fatalf("server calls are %s, want a graceful stop", calls)
+	}
+}
+
+func TestActivateLazy(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("lazy"))
+	})}
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("lazy"), Lazy()); err != nil {
+		t.Fatal(err)
+	}
+	lazy := cont.Server("lazy")
+	if lazy.Addr() != nil {
+		t.Fatalf("lazy server is bound to %v before activated", lazy.Addr())
+	}
+	// only the bound listeners are passed to the child
+	if n := len(cont.activeListeners()); n != 1 {
+		t.Fatalf("%d listeners are passed to the child, want 1", n)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	cont.setState(Running)
+
+	if err := cont.Activate("lazy"); err != nil {
+		t.Fatal(err)
+	}
+	addr := lazy.Addr()
+	if addr == nil {
+		t.Fatal("lazy server is not bound by activating")
+	}
+	if body, err := get(addr.String(), "/"); err != nil || body != "lazy" {
+		t.Fatalf("lazy server responds %q(%v)", body, err)
+	}
+	if err := cont.Activate("lazy"); err != nil || lazy.Addr() != addr {
+		t.Fatalf("activating again rebinds the listener: %v", err)
+	}
+	if n := len(cont.activeListeners()); n != 2 {
+		t.Fatalf("%d listeners are passed to the child, want 2", n)
+	}
+	if err := cont.Activate("unknown"); err != ErrUnknownServer {
+		t.Fatalf("activating an unknown server returns %v", err)
+	}
+}
+
+func TestServeEmpty(t *testing.T) {
+	if err := newTestCont(t).Serve(); err != ErrNoServers {
+		t.Fatalf("serving without servers returns %v, want ErrNoServers", err)
+	}
+
+	sigc, source := signals()
+	cont := newTestCont(t, AllowEmpty(true), source)
+	errc := serveAsync(t, cont)
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatalf("serving empty returns %v", err)
+	}
+}
+
+// syncWriter records the logs and whether they are flushed after the last write
+type syncWriter struct {
+	mu      sync.Mutex
+	logs    bytes.Buffer
+	flushed bool
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushed = false
+	return w.logs.Write(p)
+}
+
+func (w *syncWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushed = true
+	return nil
+}
+
+func TestServeFlushLogger(t *testing.T) {
+	w := &syncWriter{}
+	sigc, source := signals()
+	cont := newTestCont(t, LoggerOutput(w), source)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.logs.Len() == 0 || !w.flushed {
+		t.Fatal("logs of the shutdown are not flushed before serve returns")
+	}
+}
+
+func TestJobControl(t *testing.T) {
+	for _, sig := range newTestCont(t).signals() {
+		if sig == syscall.SIGTSTP || sig == syscall.SIGCONT {
+			t.Fatalf("%v is handled without JobControl", sig)
+		}
+	}
+
+	sigc, source := signals()
+	cont := newTestCont(t, JobControl(true), source)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	addr := func() string {
+		cont.mu.Lock()
+		defer cont.mu.Unlock()
+		return cont.servers[0].addr.String()
+	}
+
+	sigc <- syscall.SIGTSTP
+	if err := cont.WaitState(Ready, 5*time.Second); err != nil {
+		t.Fatalf("not paused by SIGTSTP: %v", err)
+	}
+	// the state is set ahead of closing the listeners
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("connection is accepted while paused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sigc <- syscall.SIGCONT
+	if err := cont.WaitState(Running, 5*time.Second); err != nil {
+		t.Fatalf("not resumed by SIGCONT: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr())
+	if err != nil {
+		t.Fatalf("connection is refused after resumed: %v", err)
+	}
+	conn.Close()
+
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopRightAfterServe(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		cont := newTestCont(t)
+		ts := NewTestServer()
+		if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+		addr := cont.servers[0].addr.String()
+		if err := cont.serve(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cont.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		// a server either has started serving before the stop and returns, or never serves
+		if !waitUntil(cont.wg.Wait, time.Now().Add(5*time.Second)) {
+			t.Fatalf("serving goroutines are leaked after stop, calls %v", ts.Calls())
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Fatal("listener is left open after stop")
+		}
+	}
+}
+
+func TestAfterBind(t *testing.T) {
+	ts := NewTestServer()
+	var bound, served bool
+	sigc, source := signals()
+	var cont *Cont
+	cont = newTestCont(t, source, AfterBind(func() error {
+		server := cont.servers[0]
+		bound, served = server.Addr() != nil, len(ts.Calls()) > 0 || cont.hasServed(server)
+		return nil
+	}))
+	if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if !bound || served {
+		t.Fatalf("after bind is called with the listener bound %v and served %v", bound, served)
+	}
+
+	failed := errors.New("drop privileges failed")
+	cont = newTestCont(t, AfterBind(func() error { return failed }))
+	ts = NewTestServer()
+	if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.Serve(); err != failed {
+		t.Fatalf("serve returns %v, want the error of after bind", err)
+	}
+	if calls := ts.Calls(); len(calls) != 0 {
+		t.Fatalf("server is served although after bind fails: %v", calls)
+	}
+}
+
+func TestIgnoreSignals(t *testing.T) {
+	cont := newTestCont(t, IgnoreSignals(syscall.SIGTERM, syscall.SIGINT))
+	handled := make(map[os.Signal]bool)
+	for _, sig := range cont.signals() {
+		handled[sig] = true
+	}
+	// the ignored signals are not registered, so they are left to the host application
+	if handled[syscall.SIGTERM] || handled[syscall.SIGINT] {
+		t.Fatalf("ignored signals are registered: %v", cont.signals())
+	}
+	for _, sig := range []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, syscall.SIGCHLD} {
+		if !handled[sig] {
+			t.Fatalf("%v is not registered", sig)
+		}
+	}
+}
+
+func TestSignalDuringStartup(t *testing.T) {
+	sigc, source := signals()
+	cont := newTestCont(t, source, Warmup(func() error {
+		// delivered before the signal loop starts
+		sigc <- syscall.SIGTERM
+		return nil
+	}))
+	ts := NewTestServer()
+	if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.Serve()
+	}()
+	if err := waitServe(t, errc); err != nil {
+		t.Fatalf("serve returns %v on the early SIGTERM", err)
+	}
+	if calls := ts.Calls(); len(calls) == 0 || calls[len(calls)-1] != "Stop" {
+		t.Fatalf("calls are %v, want stopped", calls)
+	}
+	if _, err := os.Stat(cont.pidfile); !os.IsNotExist(err) {
+		t.Fatalf("pid file is left: %v", err)
+	}
+	if cont.Status() != Stopped {
+		t.Fatalf("state is %v after stopped", cont.Status())
+	}
+}
+
+func TestToggleInvalidState(t *testing.T) {
+	w := &syncWriter{}
+	cont := newTestCont(t, LoggerOutput(w))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	for _, state := range []ContState{Draining, Stopped} {
+		cont.setState(state)
+		cont.toggle()
+		if cont.Status() != state {
+			t.Fatalf("toggle changes the state from %v to %v", state, cont.Status())
+		}
+		if conn, err := net.Dial("tcp", cont.servers[0].addr.String()); err != nil {
+			t.Fatalf("toggle when %v closes the listener: %v", state, err)
+		} else {
+			conn.Close()
+		}
+	}
+	cont.Stop()
+	// the listeners are closed already
+	cont.toggle()
+	if cont.Status() != Stopped {
+		t.Fatalf("toggle after stopped changes the state to %v", cont.Status())
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := strings.Count(w.logs.String(), "can not pause or resume"); n != 3 {
+		t.Fatalf("%d warnings of the invalid toggle, want 3", n)
+	}
+}
+
+func TestSigchldWithoutChild(t *testing.T) {
+	w := &syncWriter{}
+	sigc, source := signals()
+	cont := newTestCont(t, LoggerOutput(w), source)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	before, err := ioutil.ReadFile(cont.pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigc <- syscall.SIGCHLD
+	// the signals are handled in order, the SIGCHLD is done once the pause is seen
+	sigc <- syscall.SIGUSR1
+	if err := cont.WaitState(Ready, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(cont.pidfile)
+	if err != nil || string(after) != string(before) {
+		t.Fatalf("pid file is changed to %s(%v) by SIGCHLD, want %s", after, err, before)
+	}
+	if _, err := os.Stat(cont.pidfile + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("pid file is moved by SIGCHLD: %v", err)
+	}
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if strings.Contains(w.logs.String(), `"level":"error"`) {
+		t.Fatalf("errors are logged on SIGCHLD without a child: %s", w.logs.String())
+	}
+}
+
+func TestSignalSource(t *testing.T) {
+	for _, c := range []struct {
+		sigs    []os.Signal
+		stop    bool      // serve returns after the signals
+		state   ContState // the state after the signals if serve keeps running
+		calls   string
+		upgrade bool // the child is spawned
+	}{
+		{sigs: []os.Signal{syscall.SIGTERM}, stop: true, calls: "[Serve Stop]"},
+		{sigs: []os.Signal{syscall.SIGINT}, stop: true, calls: "[Serve Stop]"},
+		{sigs: []os.Signal{syscall.SIGQUIT}, stop: true, calls: "[Serve GracefulStop]"},
+		{sigs: []os.Signal{syscall.SIGHUP}, stop: true, calls: "[Serve GracefulStop]", upgrade: true},
+		{sigs: []os.Signal{syscall.SIGUSR1}, state: Ready, calls: "[Serve]"},
+		{sigs: []os.Signal{syscall.SIGUSR1, syscall.SIGUSR1}, state: Running, calls: "[Serve Serve]"},
+		{sigs: []os.Signal{syscall.SIGUSR2}, state: Running, calls: "[Serve]", upgrade: true},
+	} {
+		t.Run(fmt.Sprint(c.sigs), func(t *testing.T) {
+			sigc, source := signals()
+			cont := newTestCont(t, source, UpgradeTimeout(5*time.Second))
+			ts := NewTestServer()
+			if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+				t.Fatal(err)
+			}
+			childMode(t, cont, "ready")
+			events := cont.Events()
+			errc := serveAsync(t, cont)
+			waitCalls := func(want string) {
+				t.Helper()
+				for i := 0; fmt.Sprint(ts.Calls()) != want; i++ {
+					if i == 500 {
+						t.Fatalf("calls are %v, want %s", ts.Calls(), want)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			waitCalls("[Serve]")
+
+			for _, sig := range c.sigs {
+				sigc <- sig
+			}
+			if c.stop {
+				if err := waitServe(t, errc); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := cont.WaitState(c.state, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			waitCalls(c.calls)
+			if c.upgrade {
+				waitEvent(t, events, UpgradeSucceeded)
+			} else {
+				for _, et := range eventTypes(events) {
+					if et == UpgradeStarted {
+						t.Fatalf("upgrade is started by %v", c.sigs)
+					}
+				}
+			}
+			if !c.stop {
+				sigc <- syscall.SIGTERM
+				if err := waitServe(t, errc); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerFile(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("api")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	server := cont.Server("api")
+
+	rc, err := server.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sa syscall.Sockaddr
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		sa, serr = syscall.Getsockname(int(fd))
+	}); err != nil || serr != nil {
+		t.Fatalf("raw connection is not valid: %v, %v", err, serr)
+	}
+	if addr := sockaddrString(sa); addr != server.Addr().String() {
+		t.Fatalf("raw connection is bound to %s, want %s", addr, server.Addr())
+	}
+
+	f, err := server.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lis.Addr().String() != server.Addr().String() {
+		t.Fatalf("file is bound to %s, want %s", lis.Addr(), server.Addr())
+	}
+	lis.Close()
+	// closing the duplicate does not affect the listener
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("listener is closed with its file: %v", err)
+	}
+	conn.Close()
+}
+
+func TestOnStartup(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	var results []ListenResult
+	sigc, source := signals()
+	cont := newTestCont(t, source, OnStartup(func(rs []ListenResult) error {
+		results = rs
+		// at least the required ports must bind
+		for _, r := range rs {
+			if r.Err != nil && !r.Optional {
+				return r.Err
+			}
+		}
+		return nil
+	}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("required")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", taken.Addr().String()}, ServerName("optional"),
+		Optional()); err != nil {
+		t.Fatalf("optional server fails to add: %v", err)
+	}
+	errc := serveAsync(t, cont)
+	if len(results) != 2 || results[0].Err != nil || results[0].Addr == nil || results[1].Err == nil ||
+		!results[1].Optional || results[1].Addr != nil {
+		t.Fatalf("unexpected startup results %+v", results)
+	}
+
+	// the optional server is activated once the port is free
+	taken.Close()
+	if err := cont.Activate("optional"); err != nil {
+		t.Fatal(err)
+	}
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("required port failed")
+	cont = newTestCont(t, OnStartup(func(rs []ListenResult) error { return failed }))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.Serve(); err != failed {
+		t.Fatalf("serve returns %v, want the error of the startup callback", err)
+	}
+}
+
+func TestOnListenCallsCont(t *testing.T) {
+	var cont *Cont
+	listened := make(chan string, 10)
+	cont = newTestCont(t, OnListen(func(lo *ListenOn, addr net.Addr) {
+		// the accessors lock Cont, the callback is not called with the lock held
+		cont.Status()
+		cont.Config()
+		listened <- addr.String()
+	}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("rebind"),
+		Restart(RestartRebind)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("lazy"), Lazy()); err != nil {
+		t.Fatal(err)
+	}
+	<-listened
+	startServing(t, cont)
+	defer cont.Stop()
+	cont.setState(Running)
+
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-listened:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("callback is not called by %s", what)
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cont.Activate("lazy")
+	}()
+	wait("activating")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		done <- cont.Reload("rebind", SocketOptions{Backlog: 16})
+	}()
+	wait("reloading")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// the listener dies and is rebound
+	server := cont.Server("rebind")
+	cont.mu.Lock()
+	raw := server.raw
+	cont.mu.Unlock()
+	raw.Close()
+	wait("rebinding")
+}
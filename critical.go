@@ -0,0 +1,105 @@
+package continuous
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CriticalRoutes gives the requests matched by match, e.g. file uploads or exports, an extra grace period when
+// stopping gracefully. Once the shutdownTimeout exceeds, the connections without a critical request in flight
+// are closed, and the critical ones are waited for grace more before the server is closed.
+// With the DrainTimeout of Cont, the grace is taken from the end of the drain rather than added to it, the ordinary
+// connections are closed grace before the deadline, so the drain still ends in time
+func CriticalRoutes(match func(r *http.Request) bool, grace time.Duration) HTTPOption {
+	return func(s *httpServer) {
+		s.critical = &criticalRoutes{match: match, grace: grace, conns: make(map[net.Conn]string),
+			inflight: make(map[string]int)}
+	}
+}
+
+// criticalRoutes finds the connection of a request by the local and remote addresses, the connections sharing them,
+// e.g. the ones accepted by a unix socket, are all kept open while any of them serves a critical request
+type criticalRoutes struct {
+	match func(r *http.Request) bool
+	grace time.Duration
+
+	mu       sync.Mutex
+	conns    map[net.Conn]string // the addresses of every connection
+	inflight map[string]int      // the number of critical requests in flight by the addresses of the connections
+	wg       sync.WaitGroup
+}
+
+// install hooks s to track the connections and the critical requests on them
+func (cr *criticalRoutes) install(s *http.Server) {
+	connState := s.ConnState
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			cr.mu.Lock()
+			cr.conns[c] = connAddrs(c.LocalAddr(), c.RemoteAddr().String())
+			cr.mu.Unlock()
+		case http.StateClosed, http.StateHijacked:
+			cr.mu.Lock()
+			delete(cr.conns, c)
+			cr.mu.Unlock()
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+
+	handler := s.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok || !cr.match(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		addrs := connAddrs(local, r.RemoteAddr)
+		cr.add(addrs, 1)
+		defer cr.add(addrs, -1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// connAddrs identifies a connection by its addresses, r.RemoteAddr of a request is the remote address of its connection
+func connAddrs(local net.Addr, remote string) string {
+	return local.String() + "|" + remote
+}
+
+func (cr *criticalRoutes) add(addrs string, delta int) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if n := cr.inflight[addrs] + delta; n > 0 {
+		cr.inflight[addrs] = n
+	} else {
+		delete(cr.inflight, addrs)
+	}
+	cr.wg.Add(delta)
+}
+
+// drain closes the connections serving ordinary requests, then waits the critical requests for the grace period
+func (cr *criticalRoutes) drain(grace time.Duration) {
+	cr.mu.Lock()
+	for c, addrs := range cr.conns {
+		if cr.inflight[addrs] == 0 {
+			c.Close()
+		}
+	}
+	cr.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+	}
+}
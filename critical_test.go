@@ -0,0 +1,100 @@
+package continuous
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// criticalServer serves /upload as a critical request taking the duration, the others block until released
+func criticalServer(upload time.Duration, release chan struct{}) (*http.Server, chan struct{}) {
+	started := make(chan struct{}, 2)
+	return &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/upload" {
+			time.Sleep(upload)
+		} else {
+			<-release
+		}
+		w.Write([]byte("done"))
+	})}, started
+}
+
+func isUpload(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/upload")
+}
+
+// requestBoth requests an ordinary and a critical path, the results are sent to the returned channels
+func requestBoth(addr string) (ordinary, critical chan error) {
+	ordinary, critical = make(chan error, 1), make(chan error, 1)
+	go func() {
+		_, err := get(addr, "/")
+		ordinary <- err
+	}()
+	go func() {
+		body, err := get(addr, "/upload")
+		if err == nil && body != "done" {
+			err = errUnexpectedBody(body)
+		}
+		critical <- err
+	}()
+	return ordinary, critical
+}
+
+type errUnexpectedBody string
+
+func (e errUnexpectedBody) Error() string {
+	return "unexpected body " + string(e)
+}
+
+func TestCriticalRoutes(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv, started := criticalServer(shutdownTimeout+500*time.Millisecond, release)
+	s := WrapHTTPServer(srv, CriticalRoutes(isUpload, time.Second))
+	lis := serveTCP(t, s)
+	ordinary, critical := requestBoth(lis.Addr().String())
+	<-started
+	<-started
+
+	if err := s.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ordinary; err == nil {
+		t.Fatal("ordinary request is not closed after the shutdownTimeout")
+	}
+	if err := <-critical; err != nil {
+		t.Fatalf("critical request is not finished in the grace: %v", err)
+	}
+}
+
+func TestCriticalRoutesDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv, started := criticalServer(1500*time.Millisecond, release)
+	cont := newTestCont(t, DrainTimeout(2*time.Second))
+	if err := cont.AddServer(WrapHTTPServer(srv, CriticalRoutes(isUpload, time.Second)),
+		&ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	ordinary, critical := requestBoth(cont.servers[0].addr.String())
+	<-started
+	<-started
+
+	start := time.Now()
+	report, _ := cont.GracefulStopReport()
+	if elapsed := time.Since(start); elapsed > 2*time.Second+200*time.Millisecond {
+		t.Fatalf("drain takes %v, the grace is added to the DrainTimeout", elapsed)
+	}
+	if !report.Forced {
+		t.Fatal("the ordinary request is closed, but the drain is not reported forced")
+	}
+	if err := <-ordinary; err == nil {
+		t.Fatal("ordinary request is not closed")
+	}
+	if err := <-critical; err != nil {
+		t.Fatalf("critical request is not finished in the grace: %v", err)
+	}
+}
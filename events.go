@@ -0,0 +1,171 @@
+package continuous
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrWaitStateTimeout is returned by WaitState when the state is not reached in time
+var ErrWaitStateTimeout = errors.New("wait state timeout")
+
+// defaultEventBuffer is the buffer size of an events channel
+const defaultEventBuffer = 64
+
+// EventType indicates what happened in an Event
+type EventType int
+
+const (
+	// StateChanged is emitted when Cont changes its state
+	StateChanged EventType = iota
+	// UpgradeStarted is emitted when an upgrade begins
+	UpgradeStarted
+	// UpgradeSucceeded is emitted when the child is started (and ready if UpgradeTimeout is set)
+	UpgradeSucceeded
+	// UpgradeFailed is emitted when an upgrade fails
+	UpgradeFailed
+	// ChildSpawned is emitted when the child process is started
+	ChildSpawned
+	// ChildExited is emitted when the child process is reaped
+	ChildExited
+)
+
+func (et EventType) String() string {
+	switch et {
+	case StateChanged:
+		return "state-changed"
+	case UpgradeStarted:
+		return "upgrade-started"
+	case UpgradeSucceeded:
+		return "upgrade-succeeded"
+	case UpgradeFailed:
+		return "upgrade-failed"
+	case ChildSpawned:
+		return "child-spawned"
+	case ChildExited:
+		return "child-exited"
+	}
+	return ""
+}
+
+// Event is a lifecycle event of Cont
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	State ContState // the state after the event
+	Child int       // pid of the child process, if any
+	Err   error     // the reason of an UpgradeFailed
+}
+
+// Backpressure decides what to do when an events channel is full
+type Backpressure int
+
+const (
+	// DropOldest drops the oldest event in the channel to make room for the new one
+	DropOldest Backpressure = iota
+	// Block waits for the consumer to receive
+	Block
+)
+
+// EventBuffer sets the buffer size of the channels returned by Events
+func EventBuffer(size int) Option {
+	return func(cont *Cont) {
+		cont.eventBuffer = size
+	}
+}
+
+// EventBackpressure sets the policy to handle a full events channel, DropOldest by default
+func EventBackpressure(bp Backpressure) Option {
+	return func(cont *Cont) {
+		cont.backpressure = bp
+	}
+}
+
+// Events subscribes to the lifecycle events, every call returns a new channel which receives all the events
+// emitted after the subscription
+func (cont *Cont) Events() <-chan Event {
+	return cont.subscribe()
+}
+
+func (cont *Cont) subscribe() chan Event {
+	cont.eventsMu.Lock()
+	defer cont.eventsMu.Unlock()
+	size := cont.eventBuffer
+	if size <= 0 {
+		size = defaultEventBuffer
+	}
+	ch := make(chan Event, size)
+	cont.subscribers = append(cont.subscribers, ch)
+	return ch
+}
+
+// unsubscribe removes the channel and closes it, it is drained meanwhile so a blocked emit can not hold the lock
+func (cont *Cont) unsubscribe(ch chan Event) {
+	go func() {
+		for range ch {
+		}
+	}()
+	cont.eventsMu.Lock()
+	defer cont.eventsMu.Unlock()
+	for i, sub := range cont.subscribers {
+		if sub == ch {
+			cont.subscribers = append(cont.subscribers[:i], cont.subscribers[i+1:]...)
+			break
+		}
+	}
+	close(ch)
+}
+
+// WaitState blocks until Cont reaches the target state, e.g. Ready after pausing, it returns ErrWaitStateTimeout
+// if the state is not reached within the timeout
+func (cont *Cont) WaitState(target ContState, timeout time.Duration) error {
+	ch := cont.subscribe()
+	defer cont.unsubscribe(ch)
+	if cont.Status() == target {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if e.Type == StateChanged && e.State == target {
+				return nil
+			}
+		case <-timer.C:
+			return ErrWaitStateTimeout
+		}
+	}
+}
+
+// emit sends the event to all the subscribers
+func (cont *Cont) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Child == 0 {
+		e.Child = cont.child
+	}
+	e.State = cont.Status()
+
+	cont.eventsMu.Lock()
+	defer cont.eventsMu.Unlock()
+	for _, ch := range cont.subscribers {
+		if cont.backpressure == Block {
+			ch <- e
+			continue
+		}
+		for sent := false; !sent; {
+			select {
+			case ch <- e:
+				sent = true
+			default:
+				// drop the oldest one, try again if the consumer took it first
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+	}
+}
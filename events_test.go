@@ -0,0 +1,122 @@
+package continuous
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// eventTypes receives the events until the channel is idle for a while
+func eventTypes(events <-chan Event) []EventType {
+	var types []EventType
+	for {
+		select {
+		case e := <-events:
+			types = append(types, e.Type)
+		case <-time.After(100 * time.Millisecond):
+			return types
+		}
+	}
+}
+
+// waitEvent receives the events until the one of the type
+func waitEvent(t *testing.T, events <-chan Event, et EventType) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == et {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event %v", et)
+		}
+	}
+}
+
+func TestEventsUpgrade(t *testing.T) {
+	cont := newTestCont(t)
+	first, second := cont.Events(), cont.Events()
+
+	childMode(t, cont, "exit")
+	if err := cont.upgrade(); err != ErrChildExited {
+		t.Fatalf("upgrade returns %v, want ErrChildExited", err)
+	}
+	childMode(t, cont, "ready")
+	if err := cont.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprint([]EventType{UpgradeStarted, ChildSpawned, ChildExited, UpgradeFailed,
+		UpgradeStarted, ChildSpawned, UpgradeSucceeded})
+	// every subscriber receives all the events
+	for _, events := range []<-chan Event{first, second} {
+		if got := fmt.Sprint(eventTypes(events)); got != want {
+			t.Fatalf("events are %s, want %s", got, want)
+		}
+	}
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	cont := newTestCont(t, EventBuffer(2))
+	events := cont.Events()
+	for _, et := range []EventType{UpgradeStarted, ChildSpawned, UpgradeSucceeded} {
+		cont.emit(Event{Type: et})
+	}
+	want := fmt.Sprint([]EventType{ChildSpawned, UpgradeSucceeded})
+	if got := fmt.Sprint(eventTypes(events)); got != want {
+		t.Fatalf("events are %s, want the newest %s", got, want)
+	}
+}
+
+func TestEventsBlock(t *testing.T) {
+	cont := newTestCont(t, EventBuffer(1), EventBackpressure(Block))
+	events := cont.Events()
+	cont.emit(Event{Type: UpgradeStarted})
+	emitted := make(chan struct{})
+	go func() {
+		cont.emit(Event{Type: UpgradeSucceeded})
+		close(emitted)
+	}()
+	select {
+	case <-emitted:
+		t.Fatal("emit does not block on the full channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+	want := fmt.Sprint([]EventType{UpgradeStarted, UpgradeSucceeded})
+	if got := fmt.Sprint(eventTypes(events)); got != want {
+		t.Fatalf("events are %s, want %s", got, want)
+	}
+	<-emitted
+}
+
+func TestWaitState(t *testing.T) {
+	sigc, source := signals()
+	cont := newTestCont(t, source)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.WaitState(Running, 50*time.Millisecond); err != ErrWaitStateTimeout {
+		t.Fatalf("wait for a state not reached: %v, want ErrWaitStateTimeout", err)
+	}
+	errc := serveAsync(t, cont)
+
+	// pause by SIGUSR1 and wait for it
+	sigc <- syscall.SIGUSR1
+	if err := cont.WaitState(Ready, time.Second); err != nil {
+		t.Fatalf("not paused: %v", err)
+	}
+	if err := cont.WaitState(Running, 50*time.Millisecond); err != ErrWaitStateTimeout {
+		t.Fatalf("wait for running while paused: %v, want ErrWaitStateTimeout", err)
+	}
+	sigc <- syscall.SIGUSR1
+	if err := cont.WaitState(Running, time.Second); err != nil {
+		t.Fatalf("not resumed: %v", err)
+	}
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package continuous
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// ShutdownCause tells why Serve returns
+type ShutdownCause int
+
+const (
+	// CauseStartFailed means Serve failed before serving, e.g. ErrNoServers
+	CauseStartFailed ShutdownCause = iota
+	// CauseSignal means stopped by SIGTERM, SIGINT or SIGQUIT
+	CauseSignal
+	// CauseUpgraded means the child took over by SIGHUP
+	CauseUpgraded
+	// CauseContext means the context of Run is done
+	CauseContext
+	// CauseServerExited means a server with the ShutdownOnExit policy exited
+	CauseServerExited
+)
+
+func (sc ShutdownCause) String() string {
+	switch sc {
+	case CauseStartFailed:
+		return "start-failed"
+	case CauseSignal:
+		return "signal"
+	case CauseUpgraded:
+		return "upgraded"
+	case CauseContext:
+		return "context"
+	case CauseServerExited:
+		return "server-exited"
+	}
+	return ""
+}
+
+// ExitCodeFor maps the cause of the shutdown to the exit code of ServeAndExit. By default it is 1 if the start
+// failed or a server exited, and 0 for the others
+func ExitCodeFor(fn func(cause ShutdownCause) int) Option {
+	return func(cont *Cont) {
+		cont.exitCode = fn
+	}
+}
+
+// ExitFunc replaces os.Exit called by ServeAndExit, e.g. in tests
+func ExitFunc(fn func(code int)) Option {
+	return func(cont *Cont) {
+		cont.exit = fn
+	}
+}
+
+// Cause returns why Serve returns, it is meaningful after Serve returns
+func (cont *Cont) Cause() ShutdownCause {
+	return cont.cause
+}
+
+// ServeAndExit runs Serve then exits the process with the code mapped from the cause by ExitCodeFor
+func (cont *Cont) ServeAndExit() {
+	if err := cont.Serve(); err != nil {
+		cont.logger.Error("serve failed", zap.Error(err))
+	}
+	code := defaultExitCode(cont.cause)
+	if cont.exitCode != nil {
+		code = cont.exitCode(cont.cause)
+	}
+	cont.logger.Info("exit", zap.Stringer("cause", cont.cause), zap.Int("code", code))
+	cont.logger.Sync()
+
+	exit := os.Exit
+	if cont.exit != nil {
+		exit = cont.exit
+	}
+	exit(code)
+}
+
+func defaultExitCode(cause ShutdownCause) int {
+	switch cause {
+	case CauseStartFailed, CauseServerExited:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package continuous
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeAndExit(t *testing.T) {
+	custom := ExitCodeFor(func(cause ShutdownCause) int {
+		if cause == CauseSignal {
+			return 143
+		}
+		return defaultExitCode(cause)
+	})
+	for _, c := range []struct {
+		name   string
+		cause  ShutdownCause
+		code   int
+		server Continuous // no server is added if nil
+		opts   []ServerOption
+		sig    os.Signal // sent once running if set
+		extra  []Option
+	}{
+		{name: "start failed", cause: CauseStartFailed, code: 1},
+		{name: "signal", cause: CauseSignal, code: 0, server: NewTestServer(), sig: syscall.SIGTERM},
+		{name: "upgraded", cause: CauseUpgraded, code: 0, server: NewTestServer(), sig: syscall.SIGHUP},
+		{name: "server exited", cause: CauseServerExited, code: 1, server: &exitingServer{delay: 100 * time.Millisecond},
+			opts: []ServerOption{Restart(ShutdownOnExit)}},
+		{name: "custom", cause: CauseSignal, code: 143, server: NewTestServer(), sig: syscall.SIGTERM,
+			extra: []Option{custom}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			codes := make(chan int, 1)
+			sigc, source := signals()
+			opts := append([]Option{source, UpgradeTimeout(5 * time.Second), ExitFunc(func(code int) { codes <- code })},
+				c.extra...)
+			cont := newTestCont(t, opts...)
+			if c.server != nil {
+				if err := cont.AddServer(c.server, &ListenOn{"tcp", "127.0.0.1:0"}, c.opts...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			childMode(t, cont, "ready")
+			go cont.ServeAndExit()
+			if c.sig != nil {
+				if err := cont.WaitState(Running, 5*time.Second); err != nil {
+					t.Fatal(err)
+				}
+				sigc <- c.sig
+			}
+
+			select {
+			case code := <-codes:
+				if cause := cont.Cause(); cause != c.cause || code != c.code {
+					t.Fatalf("exit with %d for the cause %s, want %d for %s", code, cause, c.code, c.cause)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("serve does not exit")
+			}
+		})
+	}
+}
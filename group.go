@@ -0,0 +1,213 @@
+package continuous
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	gnet "github.com/facebookgo/grace/gracenet"
+	"go.uber.org/zap"
+)
+
+// Group runs several Cont in one process with a single signal handling. The members share the inherited listeners,
+// the first member is the leader which spawns a single child taking over the listeners of all the members
+//
+//	g := continuous.NewGroup()
+//	public := continuous.New(continuous.InGroup(g), continuous.ProcName("public"))
+//	admin := continuous.New(continuous.InGroup(g), continuous.ProcName("admin"))
+//	...
+//	g.Serve()
+type Group struct {
+	net          *gnet.Net
+	members      []*groupMember
+	signalSource <-chan os.Signal
+}
+
+// GroupOption customs the Group created by NewGroup
+type GroupOption func(g *Group)
+
+// GroupSignalSource makes the group receive the signals from c instead of the os, like SignalSource of Cont
+func GroupSignalSource(c <-chan os.Signal) GroupOption {
+	return func(g *Group) {
+		g.signalSource = c
+	}
+}
+
+// groupSignal is raised by the group to its members, it is never delivered by the os
+type groupSignal string
+
+func (s groupSignal) String() string { return string(s) }
+func (s groupSignal) Signal()        {}
+
+// sigTakenOver tells a member that the child of the leader has taken over its listeners, so it drains and returns
+const sigTakenOver = groupSignal("taken over")
+
+// sigGroupStop tells a member to drain and return since another member has returned, it stops the members
+// ignoring SIGQUIT as well
+const sigGroupStop = groupSignal("group stop")
+
+type groupMember struct {
+	cont *Cont
+	sigs chan os.Signal
+	done chan struct{}
+}
+
+// NewGroup creates an empty Group, the members join it by the InGroup option
+func NewGroup(opts ...GroupOption) *Group {
+	g := &Group{net: &gnet.Net{}}
+	for _, o := range opts {
+		o(g)
+	}
+	return g
+}
+
+// InGroup makes Cont a member of g, it receives the signals from g rather than the os and is served by g.Serve.
+// The members should have different ProcName or PidFile
+func InGroup(g *Group) Option {
+	return func(cont *Cont) {
+		m := &groupMember{cont: cont, sigs: make(chan os.Signal, 1), done: make(chan struct{})}
+		cont.net = g.net
+		cont.group = g
+		cont.signalSource = m.sigs
+		g.members = append(g.members, m)
+	}
+}
+
+func (g *Group) leader() *Cont {
+	if len(g.members) == 0 {
+		return nil
+	}
+	return g.members[0].cont
+}
+
+// members returns all the members of the group of cont, or cont itself if it is not in a group
+func (cont *Cont) members() []*Cont {
+	if cont.group == nil {
+		return []*Cont{cont}
+	}
+	conts := make([]*Cont, 0, len(cont.group.members))
+	for _, m := range cont.group.members {
+		conts = append(conts, m.cont)
+	}
+	return conts
+}
+
+// Serve runs all the members and waits to handle signals
+func (g *Group) Serve() error {
+	return g.Run(context.Background())
+}
+
+// Run is like Serve of Cont, it returns after all the members return. Once a member returns, the others are
+// stopped gracefully, and the first error is returned
+func (g *Group) Run(ctx context.Context) error {
+	if len(g.members) == 0 {
+		return ErrNoServers
+	}
+
+	// the signals handled by any member, every member only receives the ones it handles
+	handled := make([]map[os.Signal]bool, len(g.members))
+	var sigs []os.Signal
+	seen := make(map[os.Signal]bool)
+	for i, m := range g.members {
+		handled[i] = make(map[os.Signal]bool)
+		for _, sig := range m.cont.signals() {
+			handled[i][sig] = true
+			if !seen[sig] {
+				seen[sig] = true
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	c := g.signalSource
+	if c == nil {
+		notified := make(chan os.Signal, len(sigs))
+		signal.Notify(notified, sigs...)
+		defer signal.Stop(notified)
+		c = notified
+	}
+
+	type result struct {
+		m   *groupMember
+		err error
+	}
+	results := make(chan result, len(g.members))
+	for _, m := range g.members {
+		go func(m *groupMember) {
+			defer close(m.done)
+			results <- result{m, m.cont.Run(ctx)}
+		}(m)
+	}
+
+	var firstErr error
+	stopping := false
+	for running := len(g.members); running > 0; {
+		select {
+		case r := <-results:
+			running--
+			if r.err != nil && firstErr == nil {
+				firstErr = r.err
+			}
+			// after an upgrade every member is told to drain by the leader's child taking over
+			if !stopping && r.m.cont.Cause() != CauseUpgraded {
+				for _, m := range g.members {
+					g.send(m, sigGroupStop)
+				}
+			}
+			stopping = true
+		case sig := <-c:
+			switch sig {
+			case syscall.SIGUSR2, syscall.SIGCHLD:
+				// the child belongs to the leader
+				g.send(g.members[0], sig)
+			case syscall.SIGHUP:
+				go g.upgrade(handled)
+			default:
+				g.broadcast(sig, handled)
+			}
+		}
+	}
+	return firstErr
+}
+
+// upgrade lets the leader spawn the child and drain like SIGHUP, the other members drain as well once the child
+// has taken over, so all of them stop with CauseUpgraded
+func (g *Group) upgrade(handled []map[os.Signal]bool) {
+	leader := g.members[0]
+	events := leader.cont.subscribe()
+	defer leader.cont.unsubscribe(events)
+	g.send(leader, syscall.SIGHUP)
+	for {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case UpgradeSucceeded:
+				for _, m := range g.members[1:] {
+					g.send(m, sigTakenOver)
+				}
+				return
+			case UpgradeFailed:
+				leader.cont.logger.Error("upgrade group failed", zap.Error(e.Err))
+				return
+			}
+		case <-leader.done:
+			return
+		}
+	}
+}
+
+func (g *Group) broadcast(sig os.Signal, handled []map[os.Signal]bool) {
+	for i, m := range g.members {
+		if handled[i][sig] {
+			g.send(m, sig)
+		}
+	}
+}
+
+// send delivers the signal to the member unless it has returned
+func (g *Group) send(m *groupMember, sig os.Signal) {
+	select {
+	case m.sigs <- sig:
+	case <-m.done:
+	}
+}
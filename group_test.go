@@ -0,0 +1,115 @@
+package continuous
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestGroup creates a group of two members with a server each, the signals are fed by the returned channel
+func newTestGroup(t *testing.T, opts ...Option) (*Group, chan<- os.Signal, []*Cont) {
+	sigc := make(chan os.Signal, 1)
+	g := NewGroup(GroupSignalSource(sigc))
+	var members []*Cont
+	for _, name := range []string{"public", "admin"} {
+		cont := newTestCont(t, append([]Option{InGroup(g), ProcName(name)}, opts...)...)
+		if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, cont)
+	}
+	return g, sigc, members
+}
+
+// runGroup runs the group in a new goroutine and waits for all the members to run
+func runGroup(t *testing.T, g *Group, members []*Cont) <-chan error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- g.Serve()
+	}()
+	for _, cont := range members {
+		if err := cont.WaitState(Running, 5*time.Second); err != nil {
+			t.Fatalf("member is not running: %v", err)
+		}
+	}
+	return errc
+}
+
+func TestGroupSigterm(t *testing.T) {
+	g, sigc, members := newTestGroup(t)
+	errc := runGroup(t, g, members)
+
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	for _, cont := range members {
+		if state := cont.Status(); state != Stopped {
+			t.Fatalf("member %s is %s after SIGTERM, want stopped", cont.name, state)
+		}
+		if cause := cont.Cause(); cause != CauseSignal {
+			t.Fatalf("member %s stops by %s, want signal", cont.name, cause)
+		}
+	}
+}
+
+func TestGroupUpgrade(t *testing.T) {
+	var hooks []string
+	g, sigc, members := newTestGroup(t)
+	for _, cont := range members {
+		name := cont.name
+		BeforeUpgrade(func() error {
+			hooks = append(hooks, "before "+name)
+			return nil
+		})(cont)
+		AfterUpgrade(func(err error) {
+			hooks = append(hooks, "after "+name)
+		})(cont)
+	}
+	out := childMode(t, members[0], "ready")
+	errc := runGroup(t, g, members)
+
+	sigc <- syscall.SIGHUP
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	for _, cont := range members {
+		if cause := cont.Cause(); cause != CauseUpgraded {
+			t.Fatalf("member %s stops by %s, want upgraded", cont.name, cause)
+		}
+	}
+	// the child of the leader takes over the listeners of both members
+	if report := readChildReport(t, out); report.ListenFds != "2" {
+		t.Fatalf("child inherits %s listeners, want 2", report.ListenFds)
+	}
+	want := "[before public before admin after public after admin]"
+	if got := fmt.Sprint(hooks); got != want {
+		t.Fatalf("hooks run %s, want %s", got, want)
+	}
+}
+
+func TestGroupMemberExited(t *testing.T) {
+	sigc := make(chan os.Signal, 1)
+	g := NewGroup(GroupSignalSource(sigc))
+	public := newTestCont(t, InGroup(g), ProcName("public"))
+	if err := public.AddServer(&exitingServer{delay: 200 * time.Millisecond}, &ListenOn{"tcp", "127.0.0.1:0"},
+		Restart(ShutdownOnExit)); err != nil {
+		t.Fatal(err)
+	}
+	// the member ignoring SIGQUIT is stopped as well once the other returns
+	admin := newTestCont(t, InGroup(g), ProcName("admin"), IgnoreSignals(syscall.SIGQUIT))
+	if err := admin.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := runGroup(t, g, []*Cont{public, admin})
+
+	if err := waitServe(t, errc); err != ErrServerExited {
+		t.Fatalf("group returns %v, want ErrServerExited", err)
+	}
+	if state := admin.Status(); state != Stopped {
+		t.Fatalf("member admin is %s after the other exited, want stopped", state)
+	}
+}
@@ -0,0 +1,111 @@
+package continuous
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// envListenFds is the environment variable which gracenet uses to pass the count of inherited listeners
+const envListenFds = "LISTEN_FDS"
+
+// inheritedAddrs returns the addresses of the listeners inherited from the parent process. It must be called
+// before the first Listen, because gracenet closes the inherited fds after taking them over
+func inheritedAddrs() ([]string, error) {
+	countStr := os.Getenv(envListenFds)
+	if countStr == "" {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// fds 0, 1, 2 are stdin, stdout and stderr, the inherited listeners follow them
+	addrs := make([]string, 0, count)
+	for fd := 3; fd < 3+count; fd++ {
+		sa, err := syscall.Getsockname(fd)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, sockaddrString(sa))
+	}
+	return addrs, nil
+}
+
+// sockaddrString formats sa the same way as the Addr of a listener
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return (&net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}).String()
+	case *syscall.SockaddrInet6:
+		return (&net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}).String()
+	case *syscall.SockaddrUnix:
+		return sa.Name
+	}
+	return ""
+}
+
+// checkInherited warns about the configured addresses which are not inherited and the inherited listeners
+// which are not used after an upgrade, both usually mean the configuration has drifted
+func (cont *Cont) checkInherited() {
+	// the members of a group share the inherited listeners, the leader checks for all of them
+	if cont.inherited == nil || (cont.group != nil && cont.group.leader() != cont) {
+		return
+	}
+	inherited := make(map[string]bool)
+	for _, addr := range cont.inherited {
+		inherited[addr] = false
+	}
+	var servers []*ContServer
+	for _, m := range cont.members() {
+		servers = append(servers, m.servers...)
+	}
+	for _, server := range servers {
+		if server.addr == nil {
+			continue
+		}
+		addr := server.addr.String()
+		if _, ok := inherited[addr]; !ok {
+			cont.logger.Warn("listener is not inherited from the parent", zap.String("listen", server.listenOn.Address),
+				zap.String("addr", addr))
+			continue
+		}
+		inherited[addr] = true
+	}
+	for addr, used := range inherited {
+		if !used && !cont.isStatusAddr(addr) {
+			cont.logger.Warn("inherited listener is not used by any server", zap.String("addr", addr))
+		}
+	}
+}
+
+// isStatusAddr reports whether the inherited address is the one of a status server, which is bound after the check
+func (cont *Cont) isStatusAddr(addr string) bool {
+	for _, m := range cont.members() {
+		if m.statusOn != nil && sameAddr(addr, m.statusOn) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddr reports whether the inherited address is taken by listening on lo, it matches the same way as gracenet,
+// which takes the wildcard addresses of ipv4 and ipv6 as the same
+func sameAddr(addr string, lo *ListenOn) bool {
+	if !isTCP(lo.Network) {
+		return addr == lo.Address
+	}
+	resolved, err := net.ResolveTCPAddr(lo.Network, lo.Address)
+	if err != nil {
+		return false
+	}
+	trim := func(s string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(s, "[::]"), "0.0.0.0")
+	}
+	return trim(addr) == trim(resolved.String())
+}
@@ -0,0 +1,80 @@
+package continuous
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCheckInherited(t *testing.T) {
+	var logs bytes.Buffer
+	cont := newTestCont(t, LoggerOutput(&logs), StatusServer(&ListenOn{"tcp", ":19999"}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the status listener is bound after the check, it is not taken as unused
+	cont.inherited = []string{"[::]:19999", cont.servers[0].addr.String()}
+	cont.checkInherited()
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected warnings %s", logs.String())
+	}
+
+	cont.inherited = []string{"127.0.0.1:1"}
+	cont.checkInherited()
+	for _, warning := range []string{"listener is not inherited from the parent", "inherited listener is not used by any server"} {
+		if !strings.Contains(logs.String(), warning) {
+			t.Fatalf("no warning %q in %s", warning, logs.String())
+		}
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		lo   ListenOn
+		same bool
+	}{
+		{"[::]:8080", ListenOn{"tcp", ":8080"}, true},
+		{"0.0.0.0:8080", ListenOn{"tcp4", "0.0.0.0:8080"}, true},
+		{"127.0.0.1:8080", ListenOn{"tcp", "127.0.0.1:8080"}, true},
+		{"127.0.0.1:8080", ListenOn{"tcp", ":8080"}, false},
+		{"/tmp/app.sock", ListenOn{"unix", "/tmp/app.sock"}, true},
+		{"/tmp/app.sock", ListenOn{"unix", "/tmp/other.sock"}, false},
+	} {
+		if same := sameAddr(c.addr, &c.lo); same != c.same {
+			t.Errorf("sameAddr(%s, %v) = %v, want %v", c.addr, c.lo, same, c.same)
+		}
+	}
+}
+
+func TestInheritedAddrs(t *testing.T) {
+	t.Setenv(envListenFds, "")
+	if addrs, err := inheritedAddrs(); err != nil || addrs != nil {
+		t.Fatalf("not upgraded, inherited %v, %v", addrs, err)
+	}
+	t.Setenv(envListenFds, "0")
+	if addrs, err := inheritedAddrs(); err != nil || addrs == nil || len(addrs) != 0 {
+		t.Fatalf("upgraded without listeners, inherited %v, %v", addrs, err)
+	}
+	t.Setenv(envListenFds, "many")
+	if _, err := inheritedAddrs(); err == nil {
+		t.Fatal("malformed count of listeners is accepted")
+	}
+}
+
+func TestSockaddrString(t *testing.T) {
+	for _, c := range []struct {
+		sa   syscall.Sockaddr
+		want string
+	}{
+		{&syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 8080}, "127.0.0.1:8080"},
+		{&syscall.SockaddrInet6{Port: 8080}, "[::]:8080"},
+		{&syscall.SockaddrUnix{Name: "/tmp/app.sock"}, "/tmp/app.sock"},
+	} {
+		if got := sockaddrString(c.sa); got != c.want {
+			t.Errorf("sockaddrString(%v) = %s, want %s", c.sa, got, c.want)
+		}
+	}
+}
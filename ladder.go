@@ -0,0 +1,148 @@
+package continuous
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ShutdownStage is an operation of the shutdown ladder
+type ShutdownStage int
+
+const (
+	// StageDisableKeepAlives stops reusing the connections, for the servers with SetKeepAlivesEnabled like http
+	StageDisableKeepAlives ShutdownStage = iota
+	// StageGracefulStop begins the GracefulStop of the server
+	StageGracefulStop
+	// StageCancelContexts cancels the contexts of the requests in flight, for the servers with CancelContexts,
+	// e.g. the http server with TrackStreams
+	StageCancelContexts
+	// StageClose stops the server by force
+	StageClose
+)
+
+func (ss ShutdownStage) String() string {
+	switch ss {
+	case StageDisableKeepAlives:
+		return "disable-keepalives"
+	case StageGracefulStop:
+		return "graceful-stop"
+	case StageCancelContexts:
+		return "cancel-contexts"
+	case StageClose:
+		return "close"
+	}
+	return ""
+}
+
+// LadderStep runs the stage then waits for the server to stop at most Wait before the next step
+type LadderStep struct {
+	Stage ShutdownStage
+	Wait  time.Duration
+}
+
+// ShutdownLadder drains every server by the steps in order instead of the DrainTimeout, the stages a server does
+// not support are skipped. The ladder ends once the graceful stop of the server returns. The servers climb their
+// ladders side by side regardless of DependsOn, and if the DrainTimeout is set as well, no step waits beyond its
+// deadline, the servers still running then are stopped by force. For example
+//
+//	continuous.ShutdownLadder(
+//		continuous.LadderStep{Stage: continuous.StageDisableKeepAlives, Wait: time.Second},
+//		continuous.LadderStep{Stage: continuous.StageGracefulStop, Wait: 10 * time.Second},
+//		continuous.LadderStep{Stage: continuous.StageCancelContexts, Wait: 2 * time.Second},
+//		continuous.LadderStep{Stage: continuous.StageClose})
+func ShutdownLadder(steps ...LadderStep) Option {
+	return func(cont *Cont) {
+		cont.ladder = steps
+	}
+}
+
+type keepAlivesSetter interface {
+	SetKeepAlivesEnabled(v bool)
+}
+
+// ContextCanceler is implemented by the servers whose requests in flight can be canceled, e.g. the http server
+// returned by WrapHTTPServer cancels the contexts of the requests with TrackStreams, it is used by StageCancelContexts
+type ContextCanceler interface {
+	CancelContexts()
+}
+
+// climb drains the server by the shutdown ladder, bounded by the deadline if it is not zero
+func (cont *Cont) climb(server *ContServer, deadline time.Time) (forced bool, err error) {
+	// the graceful stop only shuts down the server while climbing, closing is left to the later stages,
+	// e.g. the http server does not close the connections after the shutdownTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var errc chan error
+	var stopErr error
+	for _, step := range cont.ladder {
+		cont.logger.Debug("shutdown stage", zap.String("server", server.name), zap.Stringer("stage", step.Stage))
+		switch step.Stage {
+		case StageDisableKeepAlives:
+			if ks, ok := server.srv.(keepAlivesSetter); ok {
+				ks.SetKeepAlivesEnabled(false)
+			}
+		case StageGracefulStop:
+			if errc == nil {
+				errc = make(chan error, 1)
+				go func() {
+					if cs, ok := server.srv.(contextStopper); ok {
+						errc <- cs.GracefulStopContext(ctx)
+						return
+					}
+					errc <- server.srv.GracefulStop()
+				}()
+			}
+		case StageCancelContexts:
+			if cc, ok := server.srv.(ContextCanceler); ok {
+				cc.CancelContexts()
+			}
+		case StageClose:
+			forced = true
+			stopErr = cont.stopServer(server)
+		}
+
+		wait := step.Wait
+		if left := time.Until(deadline); !deadline.IsZero() && left < wait {
+			wait = left
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case err = <-errc:
+			timer.Stop()
+			return forced, err
+		case <-timer.C:
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			cont.logger.Warn("drain timeout, stop server by force", zap.String("server", server.name),
+				zap.Stringer("stage", step.Stage))
+			forced = true
+			stopErr = cont.stopServer(server)
+			break
+		}
+	}
+
+	if errc == nil {
+		return forced, stopErr
+	}
+	// the deadline may have passed already, the server is given the forceStopTimeout to return after stopped
+	select {
+	case err = <-errc:
+	case <-time.After(forceStopTimeout):
+		cont.logger.Error("server is not stopped by the ladder, abandon it", zap.String("server", server.name))
+	}
+	if err == nil {
+		err = stopErr
+	}
+	return forced, err
+}
+
+// stopServer stops the server by force, the error is logged and returned
+func (cont *Cont) stopServer(server *ContServer) error {
+	err := server.srv.Stop()
+	if err != nil {
+		cont.logger.Error("stop server failed", zap.Error(err), zap.String("server", server.name))
+	}
+	return err
+}
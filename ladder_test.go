@@ -0,0 +1,173 @@
+package continuous
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ladderServer records the stages of the ladder, its graceful stop never finishes until it is stopped
+type ladderServer struct {
+	mu      sync.Mutex
+	stages  []string
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newLadderServer() *ladderServer {
+	return &ladderServer{stopped: make(chan struct{})}
+}
+
+func (ls *ladderServer) record(stage string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.stages = append(ls.stages, stage)
+}
+
+func (ls *ladderServer) Stages() string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return fmt.Sprint(ls.stages)
+}
+
+func (ls *ladderServer) Serve(lis net.Listener) error {
+	<-ls.stopped
+	return nil
+}
+
+func (ls *ladderServer) SetKeepAlivesEnabled(v bool) {
+	ls.record("keepalives")
+}
+
+func (ls *ladderServer) GracefulStop() error {
+	ls.record("graceful")
+	<-ls.stopped
+	return nil
+}
+
+func (ls *ladderServer) GracefulStopContext(ctx context.Context) error {
+	ls.record("graceful")
+	select {
+	case <-ls.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ls *ladderServer) CancelContexts() {
+	ls.record("cancel")
+}
+
+func (ls *ladderServer) Stop() error {
+	ls.record("stop")
+	ls.once.Do(func() { close(ls.stopped) })
+	return nil
+}
+
+// serveLadder serves the ladder servers with the options
+func serveLadder(t *testing.T, servers []*ladderServer, opts ...Option) *Cont {
+	cont := newTestCont(t, opts...)
+	for _, ls := range servers {
+		if err := cont.AddServer(ls, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startServing(t, cont)
+	return cont
+}
+
+func TestShutdownLadder(t *testing.T) {
+	ls := newLadderServer()
+	cont := serveLadder(t, []*ladderServer{ls}, ShutdownLadder(
+		LadderStep{Stage: StageDisableKeepAlives, Wait: 20 * time.Millisecond},
+		LadderStep{Stage: StageGracefulStop, Wait: 20 * time.Millisecond},
+		LadderStep{Stage: StageCancelContexts, Wait: 20 * time.Millisecond},
+		LadderStep{Stage: StageClose}))
+
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[keepalives graceful cancel stop]"; ls.Stages() != want {
+		t.Fatalf("stages are %s, want %s", ls.Stages(), want)
+	}
+	if !report.Forced {
+		t.Fatal("server closed by the ladder is not reported forced")
+	}
+}
+
+func TestShutdownLadderConcurrent(t *testing.T) {
+	servers := []*ladderServer{newLadderServer(), newLadderServer(), newLadderServer()}
+	cont := serveLadder(t, servers, ShutdownLadder(
+		LadderStep{Stage: StageGracefulStop, Wait: 300 * time.Millisecond},
+		LadderStep{Stage: StageClose}))
+
+	start := time.Now()
+	if _, err := cont.GracefulStopReport(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Fatalf("ladders take %v, they are not climbed side by side", elapsed)
+	}
+}
+
+func TestShutdownLadderDeadline(t *testing.T) {
+	ls := newLadderServer()
+	cont := serveLadder(t, []*ladderServer{ls}, DrainTimeout(200*time.Millisecond), ShutdownLadder(
+		LadderStep{Stage: StageGracefulStop, Wait: 5 * time.Second},
+		LadderStep{Stage: StageCancelContexts, Wait: 5 * time.Second}))
+
+	start := time.Now()
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ladder takes %v beyond the drain timeout", elapsed)
+	}
+	if want := "[graceful stop]"; ls.Stages() != want {
+		t.Fatalf("stages are %s, want %s", ls.Stages(), want)
+	}
+	if !report.Forced {
+		t.Fatal("server stopped at the deadline is not reported forced")
+	}
+}
+
+func TestShutdownLadderHTTP(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(shutdownTimeout + 300*time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	cont := newTestCont(t, ShutdownLadder(
+		LadderStep{Stage: StageGracefulStop, Wait: shutdownTimeout + time.Second},
+		LadderStep{Stage: StageClose}))
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	done := make(chan error, 1)
+	go func() {
+		_, err := get(cont.servers[0].addr.String(), "/")
+		done <- err
+	}()
+	<-started
+
+	// the graceful stage only shuts down, the request outlives the shutdownTimeout
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("request is closed by the graceful stage: %v", err)
+	}
+	if report.Forced {
+		t.Fatal("drained by the graceful stage, but reported forced")
+	}
+}
@@ -0,0 +1,30 @@
+package continuous
+
+// Labels identifies the listener a measurement belongs to
+type Labels struct {
+	Server     string // name of the server
+	Network    string
+	ListenAddr string
+}
+
+// Metrics receives the measurements of Cont, an adapter can export them to a monitoring system,
+// for example as prometheus metrics with the fields of Labels as the label values
+type Metrics interface {
+	// ConnOpened is called when a connection is accepted by the listener
+	ConnOpened(labels Labels)
+	// ConnClosed is called when a connection accepted by the listener is closed
+	ConnClosed(labels Labels)
+	// StateChanged is called when Cont changes its state
+	StateChanged(state ContState)
+}
+
+// MetricsHook reports the measurements to m
+func MetricsHook(m Metrics) Option {
+	return func(cont *Cont) {
+		cont.metrics = m
+	}
+}
+
+func (cs *ContServer) labels() Labels {
+	return Labels{Server: cs.name, Network: cs.listenOn.Network, ListenAddr: cs.listenOn.Address}
+}
@@ -0,0 +1,88 @@
+package continuous
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memMetrics counts the measurements in memory
+type memMetrics struct {
+	mu     sync.Mutex
+	opened map[Labels]int
+	closed map[Labels]int
+	states []ContState
+}
+
+func newMemMetrics() *memMetrics {
+	return &memMetrics{opened: make(map[Labels]int), closed: make(map[Labels]int)}
+}
+
+func (m *memMetrics) ConnOpened(labels Labels) {
+	m.mu.Lock()
+	m.opened[labels]++
+	m.mu.Unlock()
+}
+
+func (m *memMetrics) ConnClosed(labels Labels) {
+	m.mu.Lock()
+	m.closed[labels]++
+	m.mu.Unlock()
+}
+
+func (m *memMetrics) StateChanged(state ContState) {
+	m.mu.Lock()
+	m.states = append(m.states, state)
+	m.mu.Unlock()
+}
+
+func TestMetricsLabels(t *testing.T) {
+	m := newMemMetrics()
+	cont := newTestCont(t, MetricsHook(m))
+	tcp := &ListenOn{"tcp", "127.0.0.1:0"}
+	unix := &ListenOn{"unix", filepath.Join(t.TempDir(), "test.sock")}
+	if err := cont.AddServer(NewTestServer(), tcp, ServerName("tcp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), unix, ServerName("unix")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	cont.setState(Running)
+	defer cont.Stop()
+
+	conns := map[Labels]int{
+		{Server: "tcp", Network: "tcp", ListenAddr: tcp.Address}:    1,
+		{Server: "unix", Network: "unix", ListenAddr: unix.Address}: 2,
+	}
+	for labels, n := range conns {
+		addr := cont.Server(labels.Server).Addr()
+		for i := 0; i < n; i++ {
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+	}
+	for i := 0; ; i++ {
+		m.mu.Lock()
+		done := true
+		for labels, n := range conns {
+			done = done && m.opened[labels] == n && m.closed[labels] == n
+		}
+		done = done && len(m.opened) == 2 && len(m.states) == 1
+		measured := fmt.Sprint("opened ", m.opened, " closed ", m.closed, " states ", m.states)
+		m.mu.Unlock()
+		if done {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("connections are not measured by the listeners, %s", measured)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
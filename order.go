@@ -0,0 +1,53 @@
+package continuous
+
+import (
+	"go.uber.org/zap"
+)
+
+// stopOrder sorts the servers so that a server stops before the servers it depends on.
+// The insertion order is kept as much as possible, and it is used directly if the dependencies have a cycle
+func (cont *Cont) stopOrder() []*ContServer {
+	byName := make(map[string][]int)
+	for i, server := range cont.servers {
+		byName[server.name] = append(byName[server.name], i)
+	}
+
+	// dependents[i] counts the servers depending on server i which are not stopped yet
+	dependents := make([]int, len(cont.servers))
+	for _, server := range cont.servers {
+		for _, dep := range server.dependsOn {
+			idx, ok := byName[dep]
+			if !ok {
+				cont.logger.Warn("unknown dependency", zap.String("server", server.name), zap.String("depends", dep))
+				continue
+			}
+			for _, i := range idx {
+				dependents[i]++
+			}
+		}
+	}
+
+	ordered := make([]*ContServer, 0, len(cont.servers))
+	stopped := make([]bool, len(cont.servers))
+	for len(ordered) < len(cont.servers) {
+		next := -1
+		for i := range cont.servers {
+			if !stopped[i] && dependents[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			cont.logger.Warn("dependencies of servers have a cycle, stop in insertion order")
+			return cont.servers
+		}
+		stopped[next] = true
+		ordered = append(ordered, cont.servers[next])
+		for _, dep := range cont.servers[next].dependsOn {
+			for _, i := range byName[dep] {
+				dependents[i]--
+			}
+		}
+	}
+	return ordered
+}
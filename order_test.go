@@ -0,0 +1,57 @@
+package continuous
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// addServers adds a server with the name and the dependencies for each entry of deps
+func addServers(t *testing.T, cont *Cont, deps [][]string) {
+	t.Helper()
+	for _, d := range deps {
+		if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName(d[0]),
+			DependsOn(d[1:]...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	cont := newTestCont(t)
+	addServers(t, cont, [][]string{{"db"}, {"api", "cache", "db"}, {"cache", "db"}, {"admin"}})
+	startServing(t, cont)
+
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, sr := range report.Servers {
+		names = append(names, sr.Name)
+	}
+	// the dependents stop first, the others keep the insertion order
+	if got, want := fmt.Sprint(names), "[api cache db admin]"; got != want {
+		t.Fatalf("stop order is %s, want %s", got, want)
+	}
+}
+
+func TestStopOrderCycle(t *testing.T) {
+	var logs bytes.Buffer
+	cont := newTestCont(t, LoggerOutput(&logs))
+	addServers(t, cont, [][]string{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"d", "unknown"}})
+
+	var names []string
+	for _, server := range cont.stopOrder() {
+		names = append(names, server.name)
+	}
+	if got, want := fmt.Sprint(names), "[a b c d]"; got != want {
+		t.Fatalf("stop order is %s, want the insertion order %s", got, want)
+	}
+	for _, warning := range []string{"dependencies of servers have a cycle", "unknown dependency"} {
+		if !strings.Contains(logs.String(), warning) {
+			t.Fatalf("no warning %q in %s", warning, logs.String())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package continuous
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PidStore stores the pid of the serving process. During an upgrade the pid of the parent is moved aside by Backup,
+// so the child can Write its own, and it is moved back by Restore if the upgrade fails. A pid file is used by default
+type PidStore interface {
+	// Write stores the pid of the info, the rest helps a store shared by hosts to tell the stale entries
+	Write(info PidInfo) error
+	// Read returns the stored pid
+	Read() (int, error)
+	// Backup moves the stored pid aside, an error satisfying os.IsNotExist means there is no pid to move, so the
+	// upgrade goes on without restoring it. Any other error aborts the upgrade
+	Backup() error
+	// ReadOld returns the pid moved aside
+	ReadOld() (int, error)
+	// Restore moves the pid aside back
+	Restore() error
+	// Remove deletes the pids written by this store
+	Remove() error
+}
+
+// PidInfo describes the process whose pid is stored
+type PidInfo struct {
+	Pid        int
+	Start      time.Time // the time the process started
+	Executable string    // the absolute path of the binary
+}
+
+// PidBackend replaces the pid file with a custom store, for example a distributed kv
+func PidBackend(store PidStore) Option {
+	return func(cont *Cont) {
+		cont.pids = store
+		cont.noPid = false
+	}
+}
+
+// filePidStore stores the pid in a file, and backups it to the file with suffix .old
+type filePidStore struct {
+	path string
+	pid  int
+}
+
+func (s *filePidStore) Write(info PidInfo) error {
+	s.pid = info.Pid
+	return ioutil.WriteFile(s.path, []byte(fmt.Sprint(info.Pid)), 0644)
+}
+
+func (s *filePidStore) Read() (int, error) {
+	return readPid(s.path)
+}
+
+func (s *filePidStore) Backup() error {
+	return os.Rename(s.path, s.path+".old")
+}
+
+func (s *filePidStore) ReadOld() (int, error) {
+	return readPid(s.path + ".old")
+}
+
+func (s *filePidStore) Restore() error {
+	return os.Rename(s.path+".old", s.path)
+}
+
+// Remove deletes the pid file or the backup which contains the pid written by this store
+func (s *filePidStore) Remove() error {
+	for _, path := range []string{s.path, s.path + ".old"} {
+		if pid, err := readPid(path); err == nil && pid == s.pid {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nopPidStore stores nothing, it is used by Minimal. Backup reports there is no pid to move aside, so nothing is restored
+type nopPidStore struct{}
+
+func (nopPidStore) Write(info PidInfo) error { return nil }
+func (nopPidStore) Read() (int, error)       { return 0, nil }
+func (nopPidStore) Backup() error            { return os.ErrNotExist }
+func (nopPidStore) ReadOld() (int, error)    { return 0, nil }
+func (nopPidStore) Restore() error           { return nil }
+func (nopPidStore) Remove() error            { return nil }
+
+// readPid reads a pid from the file, the content should be the pid of a process which is alive
+func readPid(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("malformed pid file %s: %v", filename, err)
+	}
+	if pid <= 0 {
+		return 0, fmt.Errorf("malformed pid file %s: invalid pid %d", filename, pid)
+	}
+	// signal 0 checks the existence of the process, EPERM means it exists but is owned by others
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0, fmt.Errorf("process %d in %s is not alive: %v", pid, filename, err)
+	}
+	return pid, nil
+}
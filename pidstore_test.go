@@ -0,0 +1,241 @@
+package continuous
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memPidStore keeps the pids in memory
+type memPidStore struct {
+	mu    sync.Mutex
+	info  PidInfo
+	pid   int
+	old   int
+	calls []string
+
+	backupErr error
+}
+
+func (s *memPidStore) record(call string) {
+	s.calls = append(s.calls, call)
+}
+
+func (s *memPidStore) Write(info PidInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("Write")
+	s.info, s.pid = info, info.Pid
+	return nil
+}
+
+func (s *memPidStore) Read() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pid, nil
+}
+
+func (s *memPidStore) Backup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("Backup")
+	if s.backupErr != nil {
+		return s.backupErr
+	}
+	s.old, s.pid = s.pid, 0
+	return nil
+}
+
+func (s *memPidStore) ReadOld() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.old, nil
+}
+
+func (s *memPidStore) Restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("Restore")
+	s.pid, s.old = s.old, 0
+	return nil
+}
+
+func (s *memPidStore) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("Remove")
+	s.pid, s.old = 0, 0
+	return nil
+}
+
+func (s *memPidStore) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func TestPidBackendUpgrade(t *testing.T) {
+	store := &memPidStore{}
+	cont := newTestCont(t, PidBackend(store))
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+	if store.info.Pid != cont.pid || store.info.Start.IsZero() || store.info.Executable != cont.exe {
+		t.Fatalf("unexpected pid info %+v", store.info)
+	}
+
+	// the child fails, so the pid is restored
+	childMode(t, cont, "exit")
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+	if pid, _ := store.Read(); pid != cont.pid {
+		t.Fatalf("pid is %d after the failed upgrade, want %d", pid, cont.pid)
+	}
+
+	// the child takes over, the pid of the parent is aside
+	childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	if old, _ := store.ReadOld(); old != cont.pid {
+		t.Fatalf("old pid is %d after the upgrade, want %d", old, cont.pid)
+	}
+	want := []string{"Write", "Backup", "Restore", "Backup"}
+	if calls := store.Calls(); fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("calls are %v, want %v", calls, want)
+	}
+}
+
+func TestUpgradeWithoutPidFile(t *testing.T) {
+	cont := newTestCont(t)
+	// the pid file is never written, so there is nothing to backup
+	childMode(t, cont, "exit")
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+	for _, path := range []string{cont.pidfile, cont.pidfile + ".old"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after the failed upgrade without a pid file: %v", path, err)
+		}
+	}
+}
+
+func TestUpgradeBackupFailed(t *testing.T) {
+	errBackup := errors.New("store unavailable")
+	store := &memPidStore{backupErr: errBackup}
+	cont := newTestCont(t, PidBackend(store))
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+	childMode(t, cont, "ready")
+	if err := cont.spawn(); err != errBackup {
+		t.Fatalf("spawn returns %v, want the backup error", err)
+	}
+	if cont.child != 0 {
+		t.Fatal("child is started after the backup failed")
+	}
+	if pid, _ := store.Read(); pid != cont.pid {
+		t.Fatalf("pid is %d after the aborted upgrade, want %d", pid, cont.pid)
+	}
+	want := []string{"Write", "Backup"}
+	if calls := store.Calls(); fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("calls are %v, want %v", calls, want)
+	}
+}
+
+func TestReadPid(t *testing.T) {
+	dir := t.TempDir()
+	// a process which has exited, its pid is not alive any more
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", fmt.Sprintln(os.Getpid()), true},
+		{"malformed", "not a pid", false},
+		{"negative", "-1", false},
+		{"dead", fmt.Sprint(cmd.Process.Pid), false},
+	} {
+		path := filepath.Join(dir, c.name+".pid.old")
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pid, err := readPid(path)
+		if c.valid && (err != nil || pid != os.Getpid()) {
+			t.Fatalf("read %s pid: %d, %v", c.name, pid, err)
+		}
+		if !c.valid && err == nil {
+			t.Fatalf("read %s pid: %d, want an error", c.name, pid)
+		}
+	}
+	if _, err := readPid(filepath.Join(dir, "missing.pid.old")); !os.IsNotExist(err) {
+		t.Fatalf("read missing pid: %v, want not exist", err)
+	}
+}
+
+func TestFilePidStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pid")
+	store := &filePidStore{path: path}
+	if err := store.Write(PidInfo{Pid: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Backup(); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := store.ReadOld(); err != nil || pid != os.Getpid() {
+		t.Fatalf("read old pid: %d, %v", pid, err)
+	}
+	if _, err := store.Read(); !os.IsNotExist(err) {
+		t.Fatalf("pid is still there after the backup: %v", err)
+	}
+	if err := store.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := store.Read(); err != nil || pid != os.Getpid() {
+		t.Fatalf("read restored pid: %d, %v", pid, err)
+	}
+	if err := store.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("pid file is not removed: %v", err)
+	}
+}
+
+func TestMinimalPidFile(t *testing.T) {
+	// the options after Minimal enable the pid file again
+	path := filepath.Join(t.TempDir(), "test.pid")
+	cont := New(Minimal(), PidFile(path))
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPid(path); err != nil || pid != os.Getpid() {
+		t.Fatalf("pid file has %d(%v) after Minimal and PidFile, want %d", pid, err, os.Getpid())
+	}
+
+	// nothing is backed up without a pid, so nothing is restored when the upgrade fails
+	w := &syncWriter{}
+	cont = newTestCont(t, Minimal(), LoggerOutput(w))
+	childMode(t, cont, "exit")
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range []string{"no pid to backup", "old pid is not owned"} {
+		if logs := w.logs.String(); strings.Contains(logs, msg) {
+			t.Fatalf("%q is logged without storing the pid: %s", msg, logs)
+		}
+	}
+}
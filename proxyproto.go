@@ -0,0 +1,189 @@
+package continuous
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is the time to wait for the PROXY protocol header of a connection
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrProxyHeader is returned when a connection does not start with a valid PROXY protocol header
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+type httpServerProxyProto struct {
+	*httpServer
+}
+
+// WrapHTTPServerProxyProto wraps s like WrapHTTPServer, besides the connections are expected to start with a
+// PROXY protocol(v1 or v2) header, so r.RemoteAddr is the address of the real client behind the load balancer.
+// The header is parsed after the TLS handshake of the TLSConfig option, use the ProxyProtocol option with TLS
+func WrapHTTPServerProxyProto(s *http.Server, opts ...HTTPOption) Continuous {
+	return &httpServerProxyProto{newHTTPServer(s, opts...)}
+}
+
+func (s *httpServerProxyProto) Serve(lis net.Listener) error {
+	return s.Server.Serve(ProxyProtoListener(lis))
+}
+
+// ProxyProtocol parses the PROXY protocol header of the connections accepted by the server, unlike ListenerUpgrader
+// it is applied beneath the TLSConfig, since the header is sent in plain text ahead of the TLS handshake
+func ProxyProtocol() ServerOption {
+	return func(cs *ContServer) {
+		cs.proxyProto = true
+	}
+}
+
+// ProxyProtoListener wraps lis to parse the PROXY protocol header of the accepted connections,
+// it can be used as a ListenerUpgrader for any server
+func ProxyProtoListener(lis net.Listener) net.Listener {
+	return &proxyListener{lis}
+}
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn parses the header on the first Read or RemoteAddr, so a slow client does not block the accept loop
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.parse)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.parse)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) parse() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	b, err := c.r.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	switch b[0] {
+	case 'P':
+		c.remote, c.err = parseProxyV1(c.r)
+	case proxyV2Signature[0]:
+		c.remote, c.err = parseProxyV2(c.r)
+	default:
+		c.err = ErrProxyHeader
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// parseProxyV1 parses a header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+// the address is nil for "PROXY UNKNOWN"
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the max length of a v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyV2 parses a binary header, the address is nil for the LOCAL command or an unsupported family
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
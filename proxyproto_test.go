@@ -0,0 +1,133 @@
+package continuous
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// remoteAddrServer responds the remote address of the request
+func remoteAddrServer() *http.Server {
+	return &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+}
+
+// requestThrough sends the header then a request over conn, and returns the body of the response
+func requestThrough(t *testing.T, conn net.Conn, header []byte, wrap func(net.Conn) net.Conn) string {
+	t.Helper()
+	defer conn.Close()
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		conn = wrap(conn)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestProxyProtoV1(t *testing.T) {
+	lis := serveTCP(t, WrapHTTPServerProxyProto(remoteAddrServer()))
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote := requestThrough(t, conn, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), nil); remote != "192.0.2.1:56324" {
+		t.Fatalf("remote address is %s", remote)
+	}
+}
+
+func TestProxyProtoV2(t *testing.T) {
+	lis := serveTCP(t, WrapHTTPServerProxyProto(remoteAddrServer()))
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 192, 0, 2, 1, 192, 0, 2, 2)
+	header = binary.BigEndian.AppendUint16(header, 56324)
+	header = binary.BigEndian.AppendUint16(header, 443)
+	if remote := requestThrough(t, conn, header, nil); remote != "192.0.2.1:56324" {
+		t.Fatalf("remote address is %s", remote)
+	}
+}
+
+func TestProxyProtoTLS(t *testing.T) {
+	cont := newTestCont(t)
+	cfg := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "example.com")}}
+	if err := cont.AddServer(WrapHTTPServer(remoteAddrServer()), &ListenOn{"tcp", "127.0.0.1:0"}, TLSConfig(cfg),
+		ProxyProtocol()); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+
+	conn, err := net.Dial("tcp", cont.servers[0].addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header is sent in plain text ahead of the TLS handshake
+	remote := requestThrough(t, conn, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), func(c net.Conn) net.Conn {
+		return tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	})
+	if remote != "192.0.2.1:56324" {
+		t.Fatalf("remote address is %s", remote)
+	}
+}
+
+// tlsCheckListener records whether the accepted connections are TLS ones
+type tlsCheckListener struct {
+	net.Listener
+	tls chan bool
+}
+
+func (l *tlsCheckListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		_, ok := conn.(*tls.Conn)
+		l.tls <- ok
+	}
+	return conn, err
+}
+
+func TestListenerUpgraderAboveTLS(t *testing.T) {
+	cont := newTestCont(t)
+	accepted := make(chan bool, 1)
+	cfg := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "example.com")}}
+	if err := cont.AddServer(WrapHTTPServer(remoteAddrServer()), &ListenOn{"tcp", "127.0.0.1:0"}, TLSConfig(cfg),
+		ListenerUpgrader(func(lis net.Listener) net.Listener {
+			return &tlsCheckListener{Listener: lis, tls: accepted}
+		})); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+
+	conn, err := tls.Dial("tcp", cont.servers[0].addr.String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the upgrader wraps the tls listener, so it accepts the TLS connections
+	if !<-accepted {
+		t.Fatal("listener upgrader is applied beneath TLS")
+	}
+}
@@ -0,0 +1,118 @@
+package continuous
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SocketOptions are the socket level options of a listener
+type SocketOptions struct {
+	Backlog   int           `json:"backlog"`   // the length of the accept queue, the system default if not positive
+	KeepAlive time.Duration `json:"keepalive"` // the keep-alive period of the accepted tcp connections, the default if zero, disabled if negative
+}
+
+// Reload applies the new socket options to the listener of the server with the name. The listener is taken over
+// by a new one on the same socket, so the address is never unbound and the connections arriving meanwhile wait in
+// the backlog. The options are applied on the next bind if the listener is not bound, e.g. lazy.
+// ErrNotRunning is returned unless Cont is starting or running, e.g. paused or stopping
+func (cont *Cont) Reload(name string, so SocketOptions) error {
+	server, err := cont.reloadServer(name, so)
+	if server != nil {
+		cont.notifyListen(server)
+	}
+	return err
+}
+
+// reloadServer applies the options with mu held, it returns the server if its listener is reloaded
+func (cont *Cont) reloadServer(name string, so SocketOptions) (*ContServer, error) {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	// mu is held, so read the state directly
+	if cont.state != Running && cont.state != Starting {
+		return nil, ErrNotRunning
+	}
+	for _, server := range cont.servers {
+		if server.name != name || server.worker {
+			continue
+		}
+		server.sockopts = so
+		if cont.listener(server) == nil || cont.isDropped(server) {
+			return nil, nil
+		}
+		if err := cont.reload(server); err != nil {
+			return nil, err
+		}
+		return server, nil
+	}
+	return nil, ErrUnknownServer
+}
+
+// reload creates a listener on a duplicate of the socket, swaps it in and closes the old one
+func (cont *Cont) reload(server *ContServer) error {
+	f, ok := server.raw.(filer)
+	if !ok {
+		return errors.New("listener can not be duplicated")
+	}
+	file, err := f.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	lis, err := net.FileListener(file)
+	if err != nil {
+		return err
+	}
+
+	old, oldRaw := cont.listener(server), server.raw
+	cont.setup(server, lis)
+	// the socket is shared with the new listener, do not remove the path of a unix socket
+	if ul, ok := oldRaw.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	// the serving goroutine returns from the old listener and serves the new one
+	if err := old.Close(); err != nil {
+		cont.logger.Warn("close the reloaded listener failed", zap.Error(err), zap.String("server", server.name))
+	}
+	cont.logger.Info("listener reloaded", zap.String("server", server.name), zap.Int("backlog", server.sockopts.Backlog),
+		zap.Duration("keepalive", server.sockopts.KeepAlive))
+	return nil
+}
+
+// applySockopts sets the options on the socket of the bound listener
+func (cont *Cont) applySockopts(cs *ContServer, lis net.Listener) {
+	if cs.sockopts.Backlog <= 0 {
+		return
+	}
+	// listening again on a listening socket updates its backlog
+	if err := control(lis, func(fd uintptr) error {
+		return syscall.Listen(int(fd), cs.sockopts.Backlog)
+	}); err != nil {
+		cont.logger.Warn("set backlog failed", zap.Error(err), zap.String("listen", cs.listenOn.Address))
+	}
+}
+
+// keepAliveListener sets the keep-alive of the accepted tcp connections
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if l.period < 0 {
+			tc.SetKeepAlive(false)
+		} else {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,91 @@
+package continuous
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keepAlivePeriod finds the keep-alive period wrapped around the listener, zero if there is none
+func keepAlivePeriod(lis net.Listener) time.Duration {
+	for {
+		switch l := lis.(type) {
+		case *keepAliveListener:
+			return l.period
+		case *countListener:
+			lis = l.Listener
+		default:
+			return 0
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddServer(WrapTCPServer(echo), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("echo")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	server := cont.servers[0]
+	addr := server.addr.String()
+
+	// dial through the reload, none of the connections is refused
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var dialErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				dialErr = err
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	so := SocketOptions{Backlog: 64, KeepAlive: 5 * time.Second}
+	if err := cont.Reload("echo", so); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if dialErr != nil {
+		t.Fatalf("connection is refused during the reload: %v", dialErr)
+	}
+	if period := keepAlivePeriod(cont.listener(server)); period != so.KeepAlive {
+		t.Fatalf("keep-alive period is %v after the reload, want %v", period, so.KeepAlive)
+	}
+	if got := server.addr.String(); got != addr {
+		t.Fatalf("address is %s after the reload, want %s", got, addr)
+	}
+	if err := cont.Reload("unknown", so); err != ErrUnknownServer {
+		t.Fatalf("reload an unknown server: %v, want ErrUnknownServer", err)
+	}
+}
+
+func TestReloadNotRunning(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddServer(WrapTCPServer(echo), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("echo")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	cont.pause()
+	if err := cont.Reload("echo", SocketOptions{Backlog: 64}); err != ErrNotRunning {
+		t.Fatalf("reload while paused: %v, want ErrNotRunning", err)
+	}
+	cont.Stop()
+	if err := cont.Reload("echo", SocketOptions{Backlog: 64}); err != ErrNotRunning {
+		t.Fatalf("reload after stopped: %v, want ErrNotRunning", err)
+	}
+}
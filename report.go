@@ -0,0 +1,422 @@
+package continuous
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ServerReport describes how a server is drained
+type ServerReport struct {
+	Name     string        `json:"name"` // the bound address or the index like "server-1" if it is not named
+	Address  string        `json:"address"`
+	Duration time.Duration `json:"duration"` // time spent on draining
+	Active   int64         `json:"active"`   // connections active when the drain starts
+	Closed   int64         `json:"closed"`   // connections closed during the drain
+	Forced   bool          `json:"forced"`   // the drain exceeded the DrainTimeout and the server was stopped by force
+	Error    string        `json:"error,omitempty"`
+}
+
+// ShutdownReport describes a graceful stop
+type ShutdownReport struct {
+	Servers  []ServerReport `json:"servers"`
+	Duration time.Duration  `json:"duration"`
+	Forced   bool           `json:"forced"` // any of the servers was stopped by force
+}
+
+// deregisterTimeout bounds the OnDeregister hook
+const deregisterTimeout = 3 * time.Second
+
+// forceStopTimeout is the time to wait for a server to return from its graceful stop after stopping it by force
+const forceStopTimeout = 5 * time.Second
+
+// DrainTimeout bounds the total time of a graceful stop, including the one after upgrading by SIGHUP.
+// The servers still draining are stopped by force once the timeout exceeds. The drain is not bounded if not set.
+// The http servers and the ones wrapped by WrapGRPCServerContext drain until the timeout instead of their own default
+func DrainTimeout(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.drainTimeout = d
+	}
+}
+
+// LogShutdownReport logs the report of every graceful stop
+func LogShutdownReport(enable bool) Option {
+	return func(cont *Cont) {
+		cont.logReport = enable
+	}
+}
+
+// OnDeregister sets a function which is called once at the very beginning of a graceful stop, before any listener
+// is closed, e.g. to remove the instance from the service discovery. ctx is canceled after a short timeout, a failure
+// or a timeout is logged and the shutdown goes on. It is not called by the drain after an upgrade, the child keeps
+// serving as the same instance
+func OnDeregister(fn func(ctx context.Context) error) Option {
+	return func(cont *Cont) {
+		cont.onDeregister = fn
+	}
+}
+
+// deregister runs the OnDeregister hook once, it does not wait longer than the timeout or the deadline even if fn
+// ignores ctx
+func (cont *Cont) deregister(deadline time.Time) {
+	if cont.onDeregister == nil {
+		return
+	}
+	cont.deregisterOnce.Do(func() {
+		if err := runBounded(cont.onDeregister, boundBy(deregisterTimeout, deadline)); err != nil {
+			cont.logger.Error("deregister failed", zap.Error(err))
+		}
+	})
+}
+
+// BeforeDrain sets a function which is called once at the very beginning of a graceful stop, ahead of OnDeregister
+// and closing any listener, e.g. to resign the leadership so a standby takes over promptly. ctx is canceled after
+// the timeout, the deregisterTimeout if it is not positive, a failure or a timeout is logged and the shutdown goes on.
+// Like OnDeregister, it is not called by the drain after an upgrade
+func BeforeDrain(fn func(ctx context.Context) error, timeout time.Duration) Option {
+	return func(cont *Cont) {
+		if timeout <= 0 {
+			timeout = deregisterTimeout
+		}
+		cont.beforeDrain = fn
+		cont.resignTimeout = timeout
+	}
+}
+
+// resign runs the BeforeDrain hook once, bounded by the deadline as well
+func (cont *Cont) resign(deadline time.Time) {
+	if cont.beforeDrain == nil {
+		return
+	}
+	cont.resignOnce.Do(func() {
+		if err := runBounded(cont.beforeDrain, boundBy(cont.resignTimeout, deadline)); err != nil {
+			cont.logger.Error("before drain failed", zap.Error(err))
+		}
+	})
+}
+
+// boundBy shortens the timeout to the time left before the deadline, the deadline is ignored if it is zero
+func boundBy(timeout time.Duration, deadline time.Time) time.Duration {
+	if left := time.Until(deadline); !deadline.IsZero() && left < timeout {
+		return left
+	}
+	return timeout
+}
+
+// runBounded calls fn with a context canceled after the timeout, and returns ctx.Err() if fn does not return in time
+func runBounded(fn func(ctx context.Context) error, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownReportFile writes the report of every graceful stop to the file at path in JSON, for the post-mortem analysis
+func ShutdownReportFile(path string) Option {
+	return func(cont *Cont) {
+		cont.reportFile = path
+	}
+}
+
+// DrainCompleteFile creates the file at path when a graceful stop finishes, and removes it when the graceful stop
+// begins, so the orchestrator can poll it to know the drain is complete
+func DrainCompleteFile(path string) Option {
+	return func(cont *Cont) {
+		cont.drainFile = path
+	}
+}
+
+// writeReport replaces the report file, the file is written aside and renamed so a reader never sees a partial one
+func (cont *Cont) writeReport(report ShutdownReport) error {
+	data, err := json.MarshalIndent(struct {
+		Pid   int       `json:"pid"`
+		Time  time.Time `json:"time"`
+		State string    `json:"state"`
+		ShutdownReport
+	}{cont.pid, time.Now(), cont.Status().String(), report}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cont.reportFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cont.reportFile)
+}
+
+// Track registers a piece of background work, for example which is started by a request, the returned
+// function should be called when the work is done. GracefulStop waits for the tracked work after the servers
+// are drained, bounded by the DrainTimeout. The work tracked during the drain, e.g. by a request in flight, is waited too
+func (cont *Cont) Track() func() {
+	cont.trackMu.Lock()
+	cont.tracked++
+	cont.trackMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cont.trackMu.Lock()
+			defer cont.trackMu.Unlock()
+			if cont.tracked--; cont.tracked == 0 {
+				cont.trackIdle.Broadcast()
+			}
+		})
+	}
+}
+
+// waitTracked waits for the tracked work to finish, it returns false if the deadline exceeds
+func (cont *Cont) waitTracked(deadline time.Time) bool {
+	return waitUntil(func() {
+		cont.trackMu.Lock()
+		defer cont.trackMu.Unlock()
+		for cont.tracked > 0 {
+			cont.trackIdle.Wait()
+		}
+	}, deadline)
+}
+
+// waitUntil calls wait in a new goroutine, it returns false if wait does not return before the deadline.
+// It is not bounded if the deadline is zero
+func waitUntil(wait func(), deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// GracefulStopReport stops the servers gracefully like GracefulStop and reports how they are drained
+func (cont *Cont) GracefulStopReport() (ShutdownReport, error) {
+	return cont.gracefulStopReport(drainDeadline(cont.drainTimeout))
+}
+
+// drainDeadline returns the deadline of a drain within the timeout from now, zero if the timeout is not positive
+func drainDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// gracefulStopReport drains the servers before the deadline, the hooks ahead of the drain count in it as well.
+// It is not bounded if the deadline is zero
+func (cont *Cont) gracefulStopReport(deadline time.Time) (ShutdownReport, error) {
+	// the child takes over as the same instance after an upgrade, nothing to resign or deregister
+	if cont.cause != CauseUpgraded {
+		cont.resign(deadline)
+		cont.deregister(deadline)
+	}
+	if cont.drainFile != "" {
+		if err := os.Remove(cont.drainFile); err != nil && !os.IsNotExist(err) {
+			cont.logger.Error("remove drain complete file failed", zap.Error(err), zap.String("file", cont.drainFile))
+		}
+	}
+	// the status server is not one of the servers, it reports not ready from now on and is stopped at last,
+	// so the drain can be observed
+	cont.setState(Draining)
+	cont.closeDone()
+	cont.closeStopping()
+
+	var report ShutdownReport
+	var firstErr error
+	start := time.Now()
+	servers := cont.stopOrder()
+	srs, errs := make([]ServerReport, len(servers)), make([]error, len(servers))
+	drain := func(i int) {
+		srs[i], errs[i] = cont.drain(servers[i], deadline)
+		cont.closeListener(servers[i])
+	}
+	if len(cont.ladder) > 0 {
+		// the servers climb side by side, so a long step of one does not hold the others back
+		var wg sync.WaitGroup
+		for i := range servers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				drain(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range servers {
+			drain(i)
+		}
+	}
+	for i, sr := range srs {
+		if errs[i] != nil && firstErr == nil {
+			firstErr = errs[i]
+		}
+		report.Forced = report.Forced || sr.Forced
+		report.Servers = append(report.Servers, sr)
+	}
+	if !waitUntil(cont.workerWg.Wait, deadline) {
+		cont.logger.Warn("drain timeout, workers are not finished")
+	}
+	if !cont.waitTracked(deadline) {
+		cont.logger.Warn("drain timeout, tracked work is not finished")
+	}
+	report.Duration = time.Since(start)
+	cont.setState(Stopped)
+	cont.stopStatus()
+
+	if cont.logReport {
+		cont.logger.Info("shutdown report", zap.Duration("duration", report.Duration), zap.Bool("forced", report.Forced),
+			zap.Any("servers", report.Servers))
+	}
+	if cont.reportFile != "" {
+		if err := cont.writeReport(report); err != nil {
+			cont.logger.Error("write shutdown report failed", zap.Error(err), zap.String("file", cont.reportFile))
+		}
+	}
+	if cont.drainFile != "" {
+		if err := ioutil.WriteFile(cont.drainFile, nil, 0644); err != nil {
+			cont.logger.Error("create drain complete file failed", zap.Error(err), zap.String("file", cont.drainFile))
+		}
+	}
+	return report, firstErr
+}
+
+// closeListener closes the listener after the graceful stop, in case the server does not close it and keeps accepting
+func (cont *Cont) closeListener(server *ContServer) {
+	lis := cont.listener(server)
+	if lis == nil || cont.isDropped(server) {
+		return
+	}
+	// the child serves the same unix socket after upgrading, keep its path
+	if ul, ok := server.raw.(*net.UnixListener); ok && cont.child != 0 {
+		ul.SetUnlinkOnClose(false)
+	}
+	// it fails if the server has closed the listener already
+	lis.Close()
+}
+
+// contextStopper is a server whose graceful stop can be abandoned by cancelling ctx
+type contextStopper interface {
+	GracefulStopContext(ctx context.Context) error
+}
+
+// reportName names the server in the report. The address to listen on is the default name, it is not unique
+// like 127.0.0.1:0, so an unnamed server is named by the bound address, or by its index if it is not bound
+func (cont *Cont) reportName(server *ContServer) string {
+	if server.name != server.listenOn.Address {
+		return server.name
+	}
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	if server.addr != nil {
+		return server.addr.String()
+	}
+	for i, s := range cont.servers {
+		if s == server {
+			return fmt.Sprintf("server-%d", i)
+		}
+	}
+	return server.name
+}
+
+// drain stops the server gracefully, and stops it by force if the deadline exceeds
+func (cont *Cont) drain(server *ContServer, deadline time.Time) (ServerReport, error) {
+	sr := ServerReport{Name: cont.reportName(server), Address: server.listenOn.Address, Active: server.conns.Active()}
+	closed := server.conns.Closed()
+	start := time.Now()
+
+	// for example stopped in the warm-up, there is nothing to drain but the listener, which nobody else closes
+	if !cont.hasServed(server) {
+		if lis := cont.listener(server); lis != nil {
+			lis.Close()
+		}
+		cont.logger.Debug("server never served, skip draining", zap.String("server", server.name))
+		return sr, nil
+	}
+	if len(cont.ladder) > 0 {
+		var err error
+		sr.Forced, err = cont.climb(server, deadline)
+		sr.Duration = time.Since(start)
+		sr.Closed = server.conns.Closed() - closed
+		if err != nil {
+			sr.Error = err.Error()
+		}
+		return sr, err
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		// without a deadline, GracefulStop bounds the drain by the default of the server, e.g. the shutdownTimeout of http
+		if cs, ok := server.srv.(contextStopper); ok && !deadline.IsZero() {
+			errc <- cs.GracefulStopContext(ctx)
+			return
+		}
+		errc <- server.srv.GracefulStop()
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-timeout:
+		cont.logger.Warn("drain timeout, stop server by force", zap.String("server", server.name),
+			zap.Int64("active", server.conns.Active()))
+		sr.Forced = true
+		stopErr := cont.stopServer(server)
+		// the deadline has passed, the server is given the forceStopTimeout to return after stopped
+		select {
+		case err = <-errc:
+		case <-time.After(forceStopTimeout):
+			// do not let a stuck server hold the shutdown, e.g. the parent is going to be killed after upgrading
+			cont.logger.Error("server is not stopped by force, abandon it", zap.String("server", server.name))
+		}
+		if err == nil || err == context.DeadlineExceeded || err == context.Canceled {
+			err = stopErr
+		}
+	}
+
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		// the server abandons the graceful stop by itself
+		sr.Forced, err = true, nil
+	}
+	sr.Duration = time.Since(start)
+	sr.Closed = server.conns.Closed() - closed
+	if err != nil {
+		sr.Error = err.Error()
+	}
+	return sr, err
+}
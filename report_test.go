@@ -0,0 +1,441 @@
+package continuous
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGracefulStopReport(t *testing.T) {
+	cont := newTestCont(t, DrainTimeout(200*time.Millisecond))
+	failed := NewTestServer()
+	failed.GracefulStopErr = errors.New("graceful stop failed")
+	slow := NewTestServer()
+	slow.GracefulStopDelay = time.Second
+	for _, s := range []struct {
+		name string
+		srv  Continuous
+	}{{"quick", NewTestServer()}, {"failed", failed}, {"slow", slow}} {
+		if err := cont.AddServer(s.srv, &ListenOn{"tcp", "127.0.0.1:0"}, ServerName(s.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startServing(t, cont)
+
+	report, err := cont.GracefulStopReport()
+	if err == nil || err.Error() != "graceful stop failed" {
+		t.Fatalf("graceful stop returns %v, want the error of the failed server", err)
+	}
+	if !report.Forced || len(report.Servers) != 3 || report.Duration <= 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	quick, fail, forced := report.Servers[0], report.Servers[1], report.Servers[2]
+	if quick.Name != "quick" || quick.Forced || quick.Error != "" {
+		t.Fatalf("unexpected report of the quick server %+v", quick)
+	}
+	if fail.Name != "failed" || fail.Forced || fail.Error != "graceful stop failed" {
+		t.Fatalf("unexpected report of the failed server %+v", fail)
+	}
+	if forced.Name != "slow" || !forced.Forced || forced.Address != "127.0.0.1:0" {
+		t.Fatalf("unexpected report of the slow server %+v", forced)
+	}
+	if cont.Status() != Stopped {
+		t.Fatalf("state is %v after the graceful stop", cont.Status())
+	}
+}
+
+func TestReportNames(t *testing.T) {
+	cont := newTestCont(t)
+	for i := 0; i < 2; i++ {
+		if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, Lazy()); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+
+	// the unnamed servers share the address to listen on, they are reported by the bound address or the index
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, sr := range report.Servers {
+		names = append(names, sr.Name)
+	}
+	want := fmt.Sprint([]string{cont.servers[0].addr.String(), cont.servers[1].addr.String(), "server-2"})
+	if got := fmt.Sprint(names); got != want || names[0] == names[1] {
+		t.Fatalf("servers are reported as %s, want %s", got, want)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	cont := newTestCont(t, DrainTimeout(5*time.Second))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+
+	finished := make(chan struct{})
+	done := cont.Track()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		// the work started in the drain is waited as well
+		more := cont.Track()
+		done()
+		time.Sleep(200 * time.Millisecond)
+		close(finished)
+		more()
+	}()
+	if err := cont.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("graceful stop returns before the tracked work is done")
+	}
+}
+
+func TestTrackTimeout(t *testing.T) {
+	cont := newTestCont(t, DrainTimeout(100*time.Millisecond))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	done := cont.Track()
+	defer done()
+
+	start := time.Now()
+	cont.GracefulStop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("graceful stop waits %v for the unfinished work, longer than the DrainTimeout", elapsed)
+	}
+}
+
+func TestBeforeDrain(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	var addr string
+	resign := BeforeDrain(func(ctx context.Context) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			record("resign after close")
+			return err
+		}
+		conn.Close()
+		record("resign")
+		// the hook hangs, its timeout does not wedge the shutdown
+		<-ctx.Done()
+		return ctx.Err()
+	}, 100*time.Millisecond)
+	deregister := OnDeregister(func(ctx context.Context) error {
+		record("deregister")
+		return nil
+	})
+	cont := newTestCont(t, resign, deregister)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	addr = cont.servers[0].addr.String()
+
+	start := time.Now()
+	if _, err := cont.GracefulStopReport(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("graceful stop takes %v with a hanging hook", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "[resign deregister]"; fmt.Sprint(calls) != want {
+		t.Fatalf("hooks run %v, want %s", calls, want)
+	}
+}
+
+func TestBeforeDrainDefaultTimeout(t *testing.T) {
+	cont := newTestCont(t, BeforeDrain(func(ctx context.Context) error { return nil }, 0))
+	if cont.resignTimeout != deregisterTimeout {
+		t.Fatalf("timeout is %v, want the default %v", cont.resignTimeout, deregisterTimeout)
+	}
+}
+
+func TestDrainAfterUpgradeSkipsHooks(t *testing.T) {
+	called := false
+	hook := func(ctx context.Context) error {
+		called = true
+		return nil
+	}
+	cont := newTestCont(t, BeforeDrain(hook, time.Second), OnDeregister(hook))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	if err := cont.stopUpgraded(); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("hooks are called by the drain after an upgrade")
+	}
+	if cause := cont.Cause(); cause != CauseUpgraded {
+		t.Fatalf("cause is %s, want upgraded", cause)
+	}
+}
+
+func TestShutdownReportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	cont := newTestCont(t, ShutdownReportFile(path))
+	failed := NewTestServer()
+	failed.GracefulStopErr = errors.New("graceful stop failed")
+	if err := cont.AddServer(failed, &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("failed")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	cont.GracefulStop()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Pid   int
+		State string
+		ShutdownReport
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report is not valid JSON: %v\n%s", err, data)
+	}
+	if report.Pid != os.Getpid() || report.State != Stopped.String() || len(report.Servers) != 1 ||
+		report.Servers[0].Name != "failed" || report.Servers[0].Error != "graceful stop failed" {
+		t.Fatalf("unexpected report %s", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file of the report is left: %v", err)
+	}
+}
+
+func TestOnDeregister(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var addr string
+	release := make(chan struct{})
+	defer close(release)
+	w := &syncWriter{}
+	cont := newTestCont(t, LoggerOutput(w), DrainTimeout(300*time.Millisecond), OnDeregister(func(ctx context.Context) error {
+		call := "deregister"
+		if conn, err := net.Dial("tcp", addr); err != nil {
+			call = "deregister after close"
+		} else {
+			conn.Close()
+		}
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		// the hook hangs and ignores ctx, the shutdown goes on after the timeout
+		<-release
+		return errors.New("deregister failed")
+	}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	addr = cont.servers[0].addr.String()
+
+	start := time.Now()
+	if err := cont.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("graceful stop takes %v with a hanging deregister", elapsed)
+	}
+	cont.GracefulStop()
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(calls) != "[deregister]" {
+		t.Fatalf("deregister runs %v, want once before the listeners close", calls)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !strings.Contains(w.logs.String(), "deregister failed") {
+		t.Fatal("failure of deregister is not logged")
+	}
+}
+
+func TestGracefulStopNeverServed(t *testing.T) {
+	cont := newTestCont(t)
+	ts := NewTestServer()
+	if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	addr := cont.servers[0].addr.String()
+
+	// stopped right after binding, e.g. during the warm-up
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Servers) != 1 || report.Servers[0].Forced || report.Forced {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if calls := ts.Calls(); len(calls) != 0 {
+		t.Fatalf("server never served is drained: %v", calls)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("listener of the server never served is left open")
+	}
+	if cont.Status() != Stopped {
+		t.Fatalf("state is %v after the graceful stop", cont.Status())
+	}
+}
+
+func TestDrainCompleteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drained")
+	// a stale file of a previous drain
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cont := newTestCont(t, DrainCompleteFile(path))
+	slow := NewTestServer()
+	slow.GracefulStopDelay = 300 * time.Millisecond
+	if err := cont.AddServer(slow, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.GracefulStop()
+	}()
+	if err := cont.WaitState(Draining, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		if i == 10 {
+			t.Fatal("drain complete file exists while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("drain complete file is not created after the drain: %v", err)
+	}
+}
+
+// openServer accepts until its listener is closed, its GracefulStop leaves the listener open
+type openServer struct {
+	returned chan struct{}
+}
+
+func (s *openServer) Serve(lis net.Listener) error {
+	defer close(s.returned)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+}
+
+func (s *openServer) Stop() error         { return nil }
+func (s *openServer) GracefulStop() error { return nil }
+
+func TestGracefulStopClosesListener(t *testing.T) {
+	cont := newTestCont(t)
+	srv := &openServer{returned: make(chan struct{})}
+	if err := cont.AddServer(srv, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	addr := cont.servers[0].addr.String()
+
+	if err := cont.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.returned:
+	case <-time.After(time.Second):
+		t.Fatal("server keeps accepting after the graceful stop")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("listener is left open after the graceful stop")
+	}
+}
+
+// slowStopServer never finishes its graceful stop until stopped, its Stop takes a while and fails
+type slowStopServer struct {
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (s *slowStopServer) Serve(lis net.Listener) error {
+	<-s.stopped
+	return nil
+}
+
+func (s *slowStopServer) GracefulStop() error {
+	<-s.stopped
+	return nil
+}
+
+func (s *slowStopServer) Stop() error {
+	time.Sleep(50 * time.Millisecond)
+	s.once.Do(func() { close(s.stopped) })
+	return errors.New("stop failed")
+}
+
+func TestForceStopAfterDeadline(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"drain", nil},
+		{"ladder", []Option{ShutdownLadder(LadderStep{Stage: StageGracefulStop, Wait: time.Second})}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := &syncWriter{}
+			cont := newTestCont(t, append([]Option{LoggerOutput(w), DrainTimeout(100 * time.Millisecond)}, c.opts...)...)
+			if err := cont.AddServer(&slowStopServer{stopped: make(chan struct{})}, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+				t.Fatal(err)
+			}
+			startServing(t, cont)
+
+			report, err := cont.GracefulStopReport()
+			if err == nil || err.Error() != "stop failed" {
+				t.Fatalf("graceful stop returns %v, want the error of the force stop", err)
+			}
+			if sr := report.Servers[0]; !sr.Forced || sr.Error != "stop failed" {
+				t.Fatalf("unexpected report %+v", sr)
+			}
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if strings.Contains(w.logs.String(), "abandon it") {
+				t.Fatal("server stopped by force in a while is abandoned")
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package continuous
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// VirtualHost is a host served by SNIRouter
+type VirtualHost struct {
+	ServerName  string // the host name, a leading "*." matches any single label
+	Certificate tls.Certificate
+	Handler     http.Handler
+}
+
+// SNIRouter dispatches TLS connections to the certificates and handlers of virtual hosts by the SNI server name,
+// so a single listener can host several virtual hosts. The first virtual host is used if no one matches
+//
+//	router := continuous.NewSNIRouter(hosts...)
+//	cont.AddServer(continuous.WrapHTTPServer(&http.Server{Handler: router}), listenOn,
+//		continuous.TLSConfig(router.TLSConfig()))
+type SNIRouter struct {
+	hosts    map[string]*VirtualHost
+	fallback *VirtualHost
+}
+
+// NewSNIRouter creates a SNIRouter with the virtual hosts
+func NewSNIRouter(hosts ...VirtualHost) *SNIRouter {
+	r := &SNIRouter{hosts: make(map[string]*VirtualHost)}
+	for i := range hosts {
+		host := &hosts[i]
+		if r.fallback == nil {
+			r.fallback = host
+		}
+		r.hosts[strings.ToLower(host.ServerName)] = host
+	}
+	return r
+}
+
+// TLSConfig returns a tls.Config which presents the certificate of the virtual host matching the SNI
+func (r *SNIRouter) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.getCertificate}
+}
+
+// ServeHTTP dispatches the request to the handler of the virtual host
+func (r *SNIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := ""
+	if req.TLS != nil {
+		name = req.TLS.ServerName
+	}
+	host := r.lookup(name)
+	if host == nil || host.Handler == nil {
+		http.NotFound(w, req)
+		return
+	}
+	host.Handler.ServeHTTP(w, req)
+}
+
+func (r *SNIRouter) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := r.lookup(hello.ServerName)
+	if host == nil {
+		return nil, errors.New("no virtual host for " + hello.ServerName)
+	}
+	return &host.Certificate, nil
+}
+
+// lookup finds the virtual host by the exact name, then the wildcard name, then the fallback
+func (r *SNIRouter) lookup(name string) *VirtualHost {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if host, ok := r.hosts[name]; ok {
+		return host
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if host, ok := r.hosts["*"+name[i:]]; ok {
+			return host
+		}
+	}
+	return r.fallback
+}
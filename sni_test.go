@@ -0,0 +1,56 @@
+package continuous
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSNIRouter(t *testing.T) {
+	host := func(name string) VirtualHost {
+		return VirtualHost{ServerName: name, Certificate: testCertificate(t, name),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+			})}
+	}
+	router := NewSNIRouter(host("a.example.com"), host("*.b.example.com"))
+	cont := newTestCont(t)
+	if err := cont.AddServer(WrapHTTPServer(&http.Server{Handler: router}), &ListenOn{"tcp", "127.0.0.1:0"},
+		TLSConfig(router.TLSConfig())); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	addr := cont.servers[0].addr.String()
+
+	for _, c := range []struct {
+		sni, host string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.com.", "a.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"unknown.example.com", "a.example.com"},
+	} {
+		var cn string
+		client := &http.Client{Transport: &http.Transport{
+			DialTLS: func(network, _ string) (net.Conn, error) {
+				conn, err := tls.Dial(network, addr, &tls.Config{ServerName: c.sni, InsecureSkipVerify: true})
+				if err == nil {
+					cn = conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				}
+				return conn, err
+			},
+		}}
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if cn != c.host || string(body) != c.host {
+			t.Fatalf("%s is served by the certificate of %s and the handler of %s, want %s", c.sni, cn, body, c.host)
+		}
+	}
+}
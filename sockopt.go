@@ -0,0 +1,32 @@
+package continuous
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// control runs fn with the file descriptor of the listener
+func control(lis net.Listener, fn func(fd uintptr) error) error {
+	sc, ok := lis.(syscall.Conn)
+	if !ok {
+		return errors.New("listener does not expose the raw connection")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// isTCP reports whether the network is a tcp network
+func isTCP(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
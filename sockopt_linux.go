@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package continuous
+
+import "syscall"
+
+// tcpFastOpen is TCP_FASTOPEN defined in linux/tcp.h, which is missing in the syscall package
+const tcpFastOpen = 0x17
+
+// setFastOpen enables TCP Fast Open on a listening socket with the queue length of pending requests
+func setFastOpen(fd uintptr, qlen int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, qlen)
+}
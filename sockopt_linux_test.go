@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package continuous
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestFastOpen(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, FastOpen(16)); err != nil {
+		t.Fatal(err)
+	}
+
+	var qlen int
+	if err := control(cont.servers[0].raw, func(fd uintptr) (err error) {
+		qlen, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if qlen != 16 {
+		t.Fatalf("TCP_FASTOPEN = %d, want 16", qlen)
+	}
+}
+
+// listenBacklog reads the backlog of the listening socket, it is reported by TCP_INFO in tcpi_sacked
+func listenBacklog(fd uintptr) (int, error) {
+	var info syscall.TCPInfo
+	size := uint32(syscall.SizeofTCPInfo)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return 0, errno
+	}
+	return int(info.Sacked), nil
+}
+
+func TestReloadSockopts(t *testing.T) {
+	accepted := make(chan net.Conn, 1)
+	cont := newTestCont(t)
+	if err := cont.AddServer(WrapTCPServer(func(conn net.Conn) {
+		accepted <- conn
+		echo(conn)
+	}), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("echo")); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	server := cont.servers[0]
+
+	so := SocketOptions{Backlog: 64, KeepAlive: 7 * time.Second}
+	if err := cont.Reload("echo", so); err != nil {
+		t.Fatal(err)
+	}
+	var backlog int
+	if err := control(server.raw, func(fd uintptr) (err error) {
+		backlog, err = listenBacklog(fd)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if backlog != so.Backlog {
+		t.Fatalf("backlog is %d after the reload, want %d", backlog, so.Backlog)
+	}
+
+	conn, err := net.Dial("tcp", server.addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var sc syscall.Conn
+	select {
+	case c := <-accepted:
+		var ok bool
+		if sc, ok = c.(syscall.Conn); !ok {
+			t.Fatalf("accepted connection %T does not expose the raw connection", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not accepted after the reload")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the period is the idle time before the first probe, TCP_KEEPINTVL is set to it as well before go1.23
+	var keepAlive, idle int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if keepAlive == 0 || time.Duration(idle)*time.Second != so.KeepAlive {
+		t.Fatalf("SO_KEEPALIVE is %d and TCP_KEEPIDLE is %ds after the reload, want enabled and %v",
+			keepAlive, idle, so.KeepAlive)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package continuous
+
+import "errors"
+
+// setFastOpen fails on the platforms without TCP Fast Open support, so the option is not ignored silently
+func setFastOpen(fd uintptr, qlen int) error {
+	return errors.New("tcp fast open is not supported on this platform")
+}
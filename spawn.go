@@ -0,0 +1,229 @@
+package continuous
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// envState is the environment variable to pass the state token to the child
+const envState = "CONTINUOUS_STATE"
+
+// SerializeState sets a function which is called before starting the upgrade child, it saves the state of the
+// application, e.g. to a temp file, and returns a token like the path of the file. The child gets the token by
+// InheritedState. The upgrade fails if it returns an error
+func SerializeState(fn func() (string, error)) Option {
+	return func(cont *Cont) {
+		cont.serializeState = fn
+	}
+}
+
+// InheritedState returns the token returned by the SerializeState of the parent, it is empty if
+// the process is not started by an upgrade or the parent has no state
+func (cont *Cont) InheritedState() string {
+	return cont.inheritedState
+}
+
+// KeepGOMAXPROCS passes the current GOMAXPROCS to the upgrade child by the environment variable,
+// so a value set at runtime does not change silently after upgrading
+func KeepGOMAXPROCS(keep bool) Option {
+	return func(cont *Cont) {
+		cont.keepProcs = keep
+	}
+}
+
+// OnProcessStart sets a function which is called when Serve starts, before any server is served. upgraded reports
+// whether the process is started by an upgrade. It is the place to set the CPU affinity for example, Serve fails
+// if it returns an error
+func OnProcessStart(fn func(upgraded bool) error) Option {
+	return func(cont *Cont) {
+		cont.onProcessStart = fn
+	}
+}
+
+// Upgraded reports whether the process is started by an upgrade
+func (cont *Cont) Upgraded() bool {
+	return cont.upgraded
+}
+
+// BeforeUpgrade sets a function which is called before the upgrade child is started, e.g. to persist the state
+// of the long-lived streams. The upgrade fails if it returns an error.
+//
+// The in-flight connections, like the gRPC streams, can not be moved to the child. They keep being served by the
+// parent until the drain after SIGHUP ends, then the clients have to reconnect to the child, which resumes the
+// streams with the state handed over by SerializeState and InheritedState
+func BeforeUpgrade(fn func() error) Option {
+	return func(cont *Cont) {
+		cont.beforeUpgrade = fn
+	}
+}
+
+// AfterUpgrade sets a function which is called by the parent after an upgrade, err is nil if the child is started,
+// otherwise the parent keeps serving and should resume what it suspended in BeforeUpgrade
+func AfterUpgrade(fn func(err error)) Option {
+	return func(cont *Cont) {
+		cont.afterUpgrade = fn
+	}
+}
+
+// UpgradeDrainTimeout bounds the graceful stop after upgrading by SIGHUP instead of the DrainTimeout,
+// so the long-lived streams can be given more time to finish and migrate
+func UpgradeDrainTimeout(d time.Duration) Option {
+	return func(cont *Cont) {
+		cont.upgradeDrain = d
+	}
+}
+
+// UpgradeWorkDir sets the working directory of the upgrade child, e.g. the directory of the new release,
+// the child inherits the one of the parent if not set. The upgrade fails if it is not a directory.
+// The relative paths configured in the child, e.g. of PidFile, resolve against the new directory, so the parent
+// could not find the pid of the child unless the paths are absolute or the same files are linked there
+func UpgradeWorkDir(path string) Option {
+	return func(cont *Cont) {
+		cont.upgradeDir = path
+	}
+}
+
+// filer is a listener which exposes its file descriptor
+type filer interface {
+	File() (*os.File, error)
+}
+
+// executable resolves the absolute path of the binary to start when upgrading by os.Executable, which resolves
+// the symlinks on linux, so a release is switched by replacing the binary rather than a symlink to it.
+// os.Args[0] is used if it fails, but only if it is a path, a bare name may be found in a PATH different from ours
+func executable() (string, error) {
+	path, err := os.Executable()
+	if err == nil {
+		return path, nil
+	}
+	if !strings.ContainsRune(os.Args[0], os.PathSeparator) {
+		return "", err
+	}
+	return filepath.Abs(os.Args[0])
+}
+
+// activeListeners returns the listeners to be passed to the child, they are the ones of all
+// the members if cont is in a Group, so the single child takes over all of them
+func (cont *Cont) activeListeners() []net.Listener {
+	var listeners []net.Listener
+	for _, m := range cont.members() {
+		listeners = append(listeners, m.ownListeners()...)
+	}
+	return listeners
+}
+
+func (cont *Cont) ownListeners() []net.Listener {
+	cont.mu.Lock()
+	defer cont.mu.Unlock()
+	var listeners []net.Listener
+	for _, server := range cont.servers {
+		if server.raw != nil && !server.noInherit && !cont.isDropped(server) {
+			listeners = append(listeners, server.raw)
+		}
+	}
+	if cont.statusLis != nil {
+		listeners = append(listeners, cont.statusLis)
+	}
+	return listeners
+}
+
+// dropNotInherited closes the listeners which are not passed to the child, once the child is started
+func (cont *Cont) dropNotInherited() {
+	for _, m := range cont.members() {
+		m.mu.Lock()
+		for _, server := range m.servers {
+			if m.listener(server) != nil && server.noInherit && !m.isDropped(server) {
+				m.logger.Info("close the listener not inherited", zap.String("server", server.name))
+				m.dropListener(server)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// startProcess starts the executable as the child, which inherits the listeners the same way as gracenet does,
+// so the listeners are taken over by the gracenet of the child
+func (cont *Cont) startProcess() (int, error) {
+	if cont.exe == "" {
+		return 0, errors.New("executable path is unknown")
+	}
+	dir := cont.wd
+	if cont.upgradeDir != "" {
+		fi, err := os.Stat(cont.upgradeDir)
+		if err != nil {
+			return 0, err
+		}
+		if !fi.IsDir() {
+			return 0, fmt.Errorf("upgrade work dir %s is not a directory", cont.upgradeDir)
+		}
+		dir = cont.upgradeDir
+	}
+	var state string
+	if cont.serializeState != nil {
+		var err error
+		if state, err = cont.serializeState(); err != nil {
+			return 0, err
+		}
+	}
+
+	// the sockets are duplicated rather than passed by File, whose Fd puts them to the blocking mode, which is
+	// shared with the listeners still served here, so an Accept would block closing them
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, lis := range cont.activeListeners() {
+		fd, err := dupListener(lis)
+		if err != nil {
+			// for example it has been closed by pausing
+			cont.logger.Warn("listener can not be passed to the child", zap.Error(err), zap.Stringer("addr", lis.Addr()))
+			continue
+		}
+		defer syscall.Close(fd)
+		files = append(files, uintptr(fd))
+	}
+
+	var env []string
+	for _, v := range os.Environ() {
+		if strings.HasPrefix(v, envListenFds+"=") || strings.HasPrefix(v, envState+"=") {
+			continue
+		}
+		if cont.keepProcs && strings.HasPrefix(v, "GOMAXPROCS=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	if cont.keepProcs {
+		env = append(env, fmt.Sprintf("GOMAXPROCS=%d", runtime.GOMAXPROCS(0)))
+	}
+	env = append(env, fmt.Sprintf("%s=%d", envListenFds, len(files)-3))
+	if state != "" {
+		env = append(env, envState+"="+state)
+	}
+
+	return syscall.ForkExec(cont.exe, os.Args, &syscall.ProcAttr{
+		Dir:   dir,
+		Env:   env,
+		Files: files,
+	})
+}
+
+// dupListener duplicates the file descriptor of the listener, it is closed on exec unless it is passed to the child
+func dupListener(lis net.Listener) (int, error) {
+	var dup int
+	err := control(lis, func(fd uintptr) (err error) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if dup, err = syscall.Dup(int(fd)); err == nil {
+			syscall.CloseOnExec(dup)
+		}
+		return err
+	})
+	return dup, err
+}
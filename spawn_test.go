@@ -0,0 +1,430 @@
+package continuous
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	// envTestChild makes the test binary run as the upgrade child in the mode
+	envTestChild = "CONTINUOUS_TEST_CHILD"
+	// envTestPidFile is where the child writes its pid when it is ready
+	envTestPidFile = "CONTINUOUS_TEST_PIDFILE"
+	// envTestOut is where the child reports what it inherits
+	envTestOut = "CONTINUOUS_TEST_OUT"
+)
+
+// childReport is what the upgrade child inherits from the parent
+type childReport struct {
+	Pid        int
+	Dir        string
+	ListenFds  string
+	State      string
+	GOMAXPROCS string
+	Inherited  []string
+}
+
+// testChild runs the test binary as the upgrade child, the modes are
+//
+//	exit      exits at once like a failed exec
+//	ready     reports, writes its pid, then waits for SIGQUIT
+//	stubborn  reports and ignores SIGQUIT, so it has to be killed
+func testChild(mode string) int {
+	if mode == "exit" {
+		return 1
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+
+	dir, _ := os.Getwd()
+	inherited, err := inheritedAddrs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := childReport{Pid: os.Getpid(), Dir: dir, ListenFds: os.Getenv(envListenFds), State: os.Getenv(envState),
+		GOMAXPROCS: os.Getenv("GOMAXPROCS"), Inherited: inherited}
+	if out := os.Getenv(envTestOut); out != "" {
+		data, _ := json.Marshal(report)
+		if err := ioutil.WriteFile(out, data, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	switch mode {
+	case "ready":
+		if path := os.Getenv(envTestPidFile); path != "" {
+			ioutil.WriteFile(path, []byte(fmt.Sprint(os.Getpid())), 0644)
+		}
+		select {
+		case <-quit:
+		case <-time.After(30 * time.Second):
+		}
+	case "stubborn":
+		for {
+			<-quit
+			if out := os.Getenv(envTestOut); out != "" {
+				ioutil.WriteFile(out+".quit", nil, 0644)
+			}
+		}
+	}
+	return 0
+}
+
+// childMode makes the upgrade child of cont run in the mode, the report of the child is written to the returned path
+func childMode(t *testing.T, cont *Cont, mode string) string {
+	out := filepath.Join(t.TempDir(), "child.json")
+	t.Setenv(envTestChild, mode)
+	t.Setenv(envTestPidFile, cont.pidfile)
+	t.Setenv(envTestOut, out)
+	t.Cleanup(func() {
+		if cont.child != 0 {
+			cont.forceStopChild()
+			cont.waitChild(childStopTimeout)
+		}
+	})
+	return out
+}
+
+// readChildReport reads the report of the child
+func readChildReport(t *testing.T, path string) childReport {
+	t.Helper()
+	var report childReport
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestExecutable(t *testing.T) {
+	cont := newTestCont(t)
+	if !filepath.IsAbs(cont.exe) {
+		t.Fatalf("executable %s is not absolute", cont.exe)
+	}
+	if exe, _ := os.Executable(); cont.exe != exe {
+		t.Fatalf("executable is %s, want %s", cont.exe, exe)
+	}
+}
+
+func TestInheritOnUpgrade(t *testing.T) {
+	cont := newTestCont(t, UpgradeTimeout(5*time.Second))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}, ServerName("dropped"),
+		InheritOnUpgrade(false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	defer cont.Stop()
+	kept, dropped := cont.servers[0], cont.servers[1]
+
+	// the excluded listener keeps serving if the upgrade fails
+	childMode(t, cont, "exit")
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+	if cont.isDropped(dropped) {
+		t.Fatal("listener is dropped by the failed upgrade")
+	}
+	if conn, err := net.Dial("tcp", dropped.addr.String()); err != nil {
+		t.Fatalf("listener is closed by the failed upgrade: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	out := childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	report := readChildReport(t, out)
+	if report.ListenFds != "1" || len(report.Inherited) != 1 || report.Inherited[0] != kept.addr.String() {
+		t.Fatalf("child inherits %s listeners %v, want only %s", report.ListenFds, report.Inherited, kept.addr)
+	}
+	if !cont.isDropped(dropped) {
+		t.Fatal("listener not inherited is not dropped")
+	}
+	if conn, err := net.Dial("tcp", dropped.addr.String()); err == nil {
+		conn.Close()
+		t.Fatal("listener not inherited is still open")
+	}
+}
+
+func TestUpgradeWorkDir(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cont := newTestCont(t, UpgradeWorkDir(dir))
+	out := childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	if report := readChildReport(t, out); report.Dir != dir {
+		t.Fatalf("child runs in %s, want %s", report.Dir, dir)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cont = newTestCont(t, UpgradeWorkDir(file))
+	childMode(t, cont, "ready")
+	if err := cont.spawn(); err == nil {
+		t.Fatal("child is spawned in a work dir which is not a directory")
+	}
+}
+
+func TestStopChildEscalation(t *testing.T) {
+	cont := newTestCont(t, UpgradeTimeout(300*time.Millisecond))
+	// the stubborn child never writes its pid and ignores SIGQUIT
+	out := childMode(t, cont, "stubborn")
+	if err := cont.spawn(); err != ErrChildNotReady {
+		t.Fatalf("spawn returns %v, want ErrChildNotReady", err)
+	}
+	if _, err := os.Stat(out + ".quit"); err != nil {
+		t.Fatalf("child is not asked to stop gracefully: %v", err)
+	}
+	report := readChildReport(t, out)
+	if err := syscall.Kill(report.Pid, 0); err == nil {
+		t.Fatal("child is still alive, it is not killed")
+	}
+	if cont.child != 0 {
+		t.Fatal("killed child is still tracked")
+	}
+}
+
+func TestChildExitedRollback(t *testing.T) {
+	cont := newTestCont(t, UpgradeTimeout(5*time.Second))
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the child dies before running any of our code, the upgrade is rolled back without waiting for the timeout
+	childMode(t, cont, "exit")
+	start := time.Now()
+	if err := cont.spawn(); err != ErrChildExited {
+		t.Fatalf("spawn returns %v, want ErrChildExited", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("rollback takes %v", elapsed)
+	}
+	if cont.child != 0 {
+		t.Fatalf("dead child %d is kept", cont.child)
+	}
+	if pid, err := readPid(cont.pidfile); err != nil || pid != os.Getpid() {
+		t.Fatalf("pid is %d(%v) after the rollback, want ours %d", pid, err, os.Getpid())
+	}
+	if _, err := os.Stat(cont.pidfile + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("old pid is left: %v", err)
+	}
+}
+
+func TestUpgradeDrainEscalation(t *testing.T) {
+	sigc, source := signals()
+	cont := newTestCont(t, source, UpgradeDrainTimeout(300*time.Millisecond), UpgradeTimeout(5*time.Second))
+	// the server keeps draining for a while after stopped by force, within the forceStopTimeout
+	slow := NewTestServer()
+	slow.GracefulStopDelay = time.Second
+	if err := cont.AddServer(slow, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	childMode(t, cont, "ready")
+	errc := serveAsync(t, cont)
+
+	start := time.Now()
+	sigc <- syscall.SIGHUP
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if cont.child == 0 {
+		t.Fatal("child has not taken over")
+	}
+	// spawning the child takes a while, the drain is bounded by the UpgradeDrainTimeout, then the server returns
+	// from the graceful stop after stopped by force
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("parent exits %v after SIGHUP, the drain is not bounded", elapsed)
+	}
+	if calls := fmt.Sprint(slow.Calls()); calls != "[Serve Stop GracefulStop]" {
+		t.Fatalf("calls are %s, want stopped by force", calls)
+	}
+}
+
+func TestSerializeState(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "cache.snapshot")
+	cont := newTestCont(t, SerializeState(func() (string, error) { return token, nil }))
+	out := childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	if report := readChildReport(t, out); report.State != token {
+		t.Fatalf("child inherits the state %q, want %q", report.State, token)
+	}
+
+	// the token is read back by the new image
+	t.Setenv(envState, token)
+	if state := newTestCont(t).InheritedState(); state != token {
+		t.Fatalf("inherited state is %q, want %q", state, token)
+	}
+
+	failed := errors.New("serialize failed")
+	cont = newTestCont(t, SerializeState(func() (string, error) { return "", failed }))
+	childMode(t, cont, "ready")
+	if err := cont.spawn(); err != failed || cont.child != 0 {
+		t.Fatalf("spawn returns %v with child %d, want the error of serializing and no child", err, cont.child)
+	}
+}
+
+func TestSettleUpgrade(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.writePid(); err != nil {
+		t.Fatal(err)
+	}
+	// the child is spawned but never stores its pid, as if the stop arrives in the middle of the handoff
+	out := childMode(t, cont, "ready")
+	t.Setenv(envTestPidFile, filepath.Join(t.TempDir(), "other.pid"))
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	cont.upgradeTimeout = 300 * time.Millisecond
+	cont.settleUpgrade()
+	if cont.child != 0 {
+		t.Fatalf("child %d is left running after the upgrade is aborted", cont.child)
+	}
+	if err := syscall.Kill(readChildReport(t, out).Pid, 0); err == nil {
+		t.Fatal("child is orphaned")
+	}
+	if pid, err := readPid(cont.pidfile); err != nil || pid != os.Getpid() {
+		t.Fatalf("pid is %d(%v) after the upgrade is aborted, want ours %d", pid, err, os.Getpid())
+	}
+
+	// the child ready in time takes over the pid
+	childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	child := cont.child
+	cont.settleUpgrade()
+	if cont.child != child {
+		t.Fatal("child ready in time is stopped")
+	}
+	if pid, err := readPid(cont.pidfile); err != nil || pid != child {
+		t.Fatalf("pid is %d(%v), want the one of the child %d", pid, err, child)
+	}
+}
+
+func TestKeepGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(3))
+	t.Setenv("GOMAXPROCS", "1")
+	cont := newTestCont(t, KeepGOMAXPROCS(true))
+	out := childMode(t, cont, "ready")
+	if err := cont.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	// the value set at runtime overrides the one of the environment
+	if report := readChildReport(t, out); report.GOMAXPROCS != "3" {
+		t.Fatalf("child runs with GOMAXPROCS %q, want 3", report.GOMAXPROCS)
+	}
+}
+
+func TestOnProcessStart(t *testing.T) {
+	var upgraded []bool
+	sigc, source := signals()
+	start := OnProcessStart(func(up bool) error {
+		upgraded = append(upgraded, up)
+		return nil
+	})
+	cont := newTestCont(t, source, start, AllowEmpty(true))
+	errc := serveAsync(t, cont)
+	sigc <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+
+	// started by an upgrade
+	t.Setenv(envListenFds, "0")
+	failed := errors.New("set affinity failed")
+	cont = newTestCont(t, OnProcessStart(func(up bool) error {
+		upgraded = append(upgraded, up)
+		return failed
+	}), AllowEmpty(true))
+	if err := cont.Serve(); err != failed {
+		t.Fatalf("serve returns %v, want the error of the hook", err)
+	}
+	if fmt.Sprint(upgraded) != "[false true]" {
+		t.Fatalf("hook is called with upgraded %v, want [false true]", upgraded)
+	}
+}
+
+func TestMinUptimeBeforeUpgrade(t *testing.T) {
+	var logs syncWriter
+	cont := newTestCont(t, LoggerOutput(&logs), MinUptimeBeforeUpgrade(time.Hour))
+	childMode(t, cont, "ready")
+	if err := cont.upgrade(); err != ErrUpgradeTooEarly {
+		t.Fatalf("upgrade returns %v, want ErrUpgradeTooEarly", err)
+	}
+	if cont.child != 0 {
+		t.Fatal("child is spawned before the min uptime")
+	}
+	logs.mu.Lock()
+	warned := strings.Contains(logs.logs.String(), "upgrade refused, the process is not up long enough")
+	logs.mu.Unlock()
+	if !warned {
+		t.Fatal("no warning of the early upgrade")
+	}
+
+	cont.started = time.Now().Add(-time.Hour)
+	if err := cont.upgrade(); err != nil {
+		t.Fatalf("upgrade after the min uptime: %v", err)
+	}
+}
+
+func TestUpgradeHooks(t *testing.T) {
+	var calls []string
+	var beforeErr error
+	cont := newTestCont(t, BeforeUpgrade(func() error {
+		calls = append(calls, "before")
+		return beforeErr
+	}), AfterUpgrade(func(err error) {
+		calls = append(calls, fmt.Sprintf("after(%v)", err))
+	}))
+
+	childMode(t, cont, "exit")
+	if err := cont.upgrade(); err != ErrChildExited {
+		t.Fatalf("upgrade returns %v, want ErrChildExited", err)
+	}
+	// the state of the streams is persisted before the child starts, and resumed when the upgrade fails
+	childMode(t, cont, "ready")
+	if err := cont.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	child := cont.child
+
+	beforeErr = errors.New("persist failed")
+	if err := cont.upgrade(); err != beforeErr || cont.child != child {
+		t.Fatalf("upgrade returns %v, want the error of the hook and no child spawned", err)
+	}
+	want := fmt.Sprint([]string{"before", "after(" + ErrChildExited.Error() + ")", "before", "after(<nil>)", "before"})
+	if got := fmt.Sprint(calls); got != want {
+		t.Fatalf("hooks are called %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package continuous
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// livenessTimeout is the time /livez waits for the state lock, a longer wait means a deadlock
+const livenessTimeout = time.Second
+
+// StatusServer serves the status endpoints on listenOn, the listener is passed to the child when upgrading
+//
+//	/livez   200 as long as the process is alive and not deadlocked
+//	/readyz  200 when the servers are running, 503 when starting, draining, paused or stopped
+//	/config  the effective configuration returned by Config in JSON
+func StatusServer(listenOn *ListenOn) Option {
+	return func(cont *Cont) {
+		cont.statusOn = listenOn
+	}
+}
+
+func (cont *Cont) startStatus() error {
+	if cont.statusOn == nil {
+		return nil
+	}
+	lis, err := cont.bind(cont.statusOn.Network, cont.statusOn.Address)
+	if err != nil {
+		return err
+	}
+	cont.statusLis = lis
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", cont.livez)
+	mux.HandleFunc("/readyz", cont.readyz)
+	mux.HandleFunc("/config", cont.config)
+	cont.status = &http.Server{Handler: mux}
+	go func() {
+		if err := cont.status.Serve(lis); err != nil && err != http.ErrServerClosed {
+			cont.logger.Error("serve status failed", zap.Error(err), zap.String("listen", cont.statusOn.Address))
+		}
+	}()
+	return nil
+}
+
+// stopStatus closes the status server after all the servers are stopped, it can be called more than once
+func (cont *Cont) stopStatus() {
+	if cont.status == nil {
+		return
+	}
+	if err := cont.status.Close(); err != nil {
+		cont.logger.Error("stop status server failed", zap.Error(err))
+	}
+}
+
+func (cont *Cont) livez(w http.ResponseWriter, r *http.Request) {
+	// the state lock is used by every transition, failing to take it in time means the process is stuck
+	if !cont.lockable(livenessTimeout) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("deadlocked"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (cont *Cont) readyz(w http.ResponseWriter, r *http.Request) {
+	state := cont.Status()
+	if state == Running {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(state.String()))
+}
+
+// lockable reports whether the state lock is taken within the timeout. A single goroutine waits for the lock, the
+// probes of a stuck process share it, so they do not pile up on the lock
+func (cont *Cont) lockable(timeout time.Duration) bool {
+	cont.probeMu.Lock()
+	probe := cont.probe
+	if probe == nil {
+		probe = make(chan struct{})
+		cont.probe = probe
+		go func() {
+			cont.mu.Lock()
+			cont.mu.Unlock()
+			cont.probeMu.Lock()
+			cont.probe = nil
+			cont.probeMu.Unlock()
+			close(probe)
+		}()
+	}
+	cont.probeMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-probe:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
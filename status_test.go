@@ -0,0 +1,147 @@
+package continuous
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// probe requests the path of the status server and returns the status code
+func probe(t *testing.T, cont *Cont, path string) int {
+	t.Helper()
+	resp, err := http.Get("http://" + cont.statusLis.Addr().String() + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStatusDuringDrain(t *testing.T) {
+	sigs, source := signals()
+	cont := newTestCont(t, source, StatusServer(&ListenOn{"tcp", "127.0.0.1:0"}))
+	slow := NewTestServer()
+	slow.GracefulStopDelay = 500 * time.Millisecond
+	if err := cont.AddServer(slow, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	if code := probe(t, cont, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz is %d when running", code)
+	}
+
+	sigs <- syscall.SIGQUIT
+	if err := cont.WaitState(Draining, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the status server keeps serving while the servers are draining
+	if code := probe(t, cont, "/livez"); code != http.StatusOK {
+		t.Fatalf("livez is %d when draining", code)
+	}
+	if code := probe(t, cont, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz is %d when draining", code)
+	}
+	waitServe(t, errc)
+}
+
+func TestLivezDeadlocked(t *testing.T) {
+	cont := newTestCont(t)
+	cont.mu.Lock()
+	rec := httptest.NewRecorder()
+	cont.livez(rec, httptest.NewRequest("GET", "/livez", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("livez is %d when the state lock is stuck", rec.Code)
+	}
+	// the probes of a stuck process share the goroutine waiting for the lock
+	cont.probeMu.Lock()
+	pending := cont.probe
+	cont.probeMu.Unlock()
+	if cont.lockable(10 * time.Millisecond) {
+		t.Fatal("state lock is taken while it is held")
+	}
+	cont.probeMu.Lock()
+	shared := cont.probe == pending
+	cont.probeMu.Unlock()
+	if !shared {
+		t.Fatal("probe of a stuck process waits for the lock by itself")
+	}
+	cont.mu.Unlock()
+	<-pending
+
+	rec = httptest.NewRecorder()
+	cont.livez(rec, httptest.NewRequest("GET", "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("livez is %d when the state lock is free", rec.Code)
+	}
+}
+
+func TestReadyzDuringWarmup(t *testing.T) {
+	warming, release := make(chan struct{}), make(chan struct{})
+	sigs, source := signals()
+	cont := newTestCont(t, source, StatusServer(&ListenOn{"tcp", "127.0.0.1:0"}), Warmup(func() error {
+		close(warming)
+		<-release
+		return nil
+	}))
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.Serve()
+	}()
+
+	<-warming
+	if code := probe(t, cont, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz is %d during the warm-up", code)
+	}
+	if cont.hasServed(cont.servers[0]) {
+		t.Fatal("server is served during the warm-up")
+	}
+	close(release)
+	if err := cont.WaitState(Running, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code := probe(t, cont, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz is %d after the warm-up", code)
+	}
+	sigs <- syscall.SIGTERM
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatusStoppedLast(t *testing.T) {
+	cont := newTestCont(t, StatusServer(&ListenOn{"tcp", "127.0.0.1:0"}))
+	slow := NewTestServer()
+	slow.GracefulStopDelay = 300 * time.Millisecond
+	if err := cont.AddServer(slow, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.startStatus(); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	addr := cont.statusLis.Addr().String()
+
+	reportc := make(chan ShutdownReport, 1)
+	go func() {
+		report, _ := cont.GracefulStopReport()
+		reportc <- report
+	}()
+	if err := cont.WaitState(Draining, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code := probe(t, cont, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz is %d while the servers are draining", code)
+	}
+	// the status server is not drained as one of the servers, but closed after them
+	if report := <-reportc; len(report.Servers) != 1 {
+		t.Fatalf("report has servers %+v, want only the user server", report.Servers)
+	}
+	if _, err := http.Get("http://" + addr + "/livez"); err == nil {
+		t.Fatal("status server is still open after stopped")
+	}
+}
@@ -0,0 +1,128 @@
+package continuous
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TrackStreams tracks the streaming responses like Server-Sent Events, which are flushed by the handlers and never
+// become idle for the graceful shutdown. When the shutdownTimeout exceeds, the contexts of the requests are
+// canceled, so the handlers watching r.Context() can end the streams before the server is closed.
+// With the DrainTimeout of Cont, the contexts are canceled before the deadline to leave the streams the time to end,
+// the shutdownTimeout or half of the drain left, whichever is shorter
+func TrackStreams() HTTPOption {
+	return func(s *httpServer) {
+		s.streams = &streams{requests: make(map[*streamWriter]struct{}), active: make(map[*streamWriter]struct{})}
+	}
+}
+
+type streams struct {
+	mu       sync.Mutex
+	canceled bool // the contexts are canceled, the ones of the requests coming later are canceled at once
+	requests map[*streamWriter]struct{}
+	active   map[*streamWriter]struct{}
+}
+
+// install hooks s to cancel the contexts of the requests and to find the streaming responses
+func (st *streams) install(s *http.Server) {
+	handler := s.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		sw := &streamWriter{ResponseWriter: w, streams: st, cancel: cancel, done: make(chan struct{})}
+		st.begin(sw)
+		defer sw.finish()
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// begin tracks the request until it finishes, its context is canceled at once if the contexts are canceled already
+func (st *streams) begin(sw *streamWriter) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.requests[sw] = struct{}{}
+	if st.canceled {
+		sw.cancel()
+	}
+}
+
+// stop cancels the contexts of all the requests and waits the streams to end within the timeout
+func (st *streams) stop(timeout time.Duration) {
+	st.cancel()
+	st.mu.Lock()
+	var dones []chan struct{}
+	for sw := range st.active {
+		dones = append(dones, sw.done)
+	}
+	st.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// cancel cancels the contexts of all the requests
+func (st *streams) cancel() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.canceled = true
+	for sw := range st.requests {
+		sw.cancel()
+	}
+}
+
+// streamWriter marks the response as a stream once it is flushed
+type streamWriter struct {
+	http.ResponseWriter
+	streams   *streams
+	streaming bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func (w *streamWriter) Flush() {
+	if !w.streaming {
+		w.streaming = true
+		w.streams.mu.Lock()
+		w.streams.active[w] = struct{}{}
+		w.streams.mu.Unlock()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack keeps the websockets working through the wrapper
+func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijack not supported")
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *streamWriter) finish() {
+	w.streams.mu.Lock()
+	delete(w.streams.requests, w)
+	delete(w.streams.active, w)
+	w.streams.mu.Unlock()
+	w.cancel()
+	close(w.done)
+}
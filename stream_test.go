@@ -0,0 +1,96 @@
+package continuous
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// sseServer streams an event every 10ms until the request context is canceled
+func sseServer() *http.Server {
+	return &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	})}
+}
+
+// openStream opens the stream and reads it in a new goroutine, the returned channel is closed when it ends
+func openStream(t *testing.T, addr string) <-chan struct{} {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		defer resp.Body.Close()
+		r := bufio.NewReader(resp.Body)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	return ended
+}
+
+func TestTrackStreams(t *testing.T) {
+	s := WrapHTTPServer(sseServer(), TrackStreams())
+	lis := serveTCP(t, s)
+	ended := openStream(t, lis.Addr().String())
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := s.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > shutdownTimeout+500*time.Millisecond {
+		t.Fatalf("graceful stop takes %v with an open stream", elapsed)
+	}
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("stream does not end on graceful stop")
+	}
+}
+
+func TestTrackStreamsDrainTimeout(t *testing.T) {
+	drain := 1500 * time.Millisecond
+	cont := newTestCont(t, DrainTimeout(drain))
+	if err := cont.AddServer(WrapHTTPServer(sseServer(), TrackStreams()), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	ended := openStream(t, cont.servers[0].addr.String())
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		cont.GracefulStopReport()
+		close(stopped)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(drain + time.Second):
+		t.Fatal("stream does not end within the drain timeout")
+	}
+	// the streams are given half of the drain to end
+	if elapsed := time.Since(start); elapsed < drain/4 || elapsed > drain {
+		t.Fatalf("stream ends after %v, want before the deadline with the time left to end", elapsed)
+	}
+	<-stopped
+	if elapsed := time.Since(start); elapsed > drain+200*time.Millisecond {
+		t.Fatalf("drain takes %v, the stream wait is added to the DrainTimeout", elapsed)
+	}
+}
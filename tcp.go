@@ -0,0 +1,313 @@
+package continuous
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by the Serve of a tcp server after it is stopped
+var ErrServerClosed = errors.New("tcp server closed")
+
+// TCPOption customs the tcp server created by WrapTCPServer
+type TCPOption func(s *tcpServer)
+
+// IdleTimeout closes the connections which have no data read or written for longer than d
+func IdleTimeout(d time.Duration) TCPOption {
+	return func(s *tcpServer) {
+		s.idleTimeout = d
+	}
+}
+
+// CloseGrace closes connections by force gracefully, a FIN is sent to the client first, then the connection
+// is closed after the client closes it or the grace period d exceeds, so clients are not reset
+func CloseGrace(d time.Duration) TCPOption {
+	return func(s *tcpServer) {
+		s.closeGrace = d
+	}
+}
+
+// quiescePollInterval is the interval to check the busy connections when stopping gracefully
+const quiescePollInterval = 100 * time.Millisecond
+
+// BusyFunc tells whether a connection is in flight, e.g. a query is executing on a connection of a database proxy.
+// The graceful stop closes the connections once they are not busy, rather than waiting them to be closed.
+// busy is called with the server locked, so it must not block, and it receives the connection as passed to the
+// handler, e.g. wrapped by IdleTimeout
+func BusyFunc(busy func(conn net.Conn) bool) TCPOption {
+	return func(s *tcpServer) {
+		s.busy = busy
+	}
+}
+
+type tcpServer struct {
+	handler     func(conn net.Conn)
+	idleTimeout time.Duration
+	closeGrace  time.Duration
+	busy        func(conn net.Conn) bool
+
+	mu     sync.Mutex
+	closed bool
+	lis    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// WrapTCPServer creates a Continuous which serves every accepted connection with the handler in a new goroutine,
+// the connection is closed after the handler returns
+func WrapTCPServer(handler func(conn net.Conn), opts ...TCPOption) Continuous {
+	s := &tcpServer{handler: handler, lis: make(map[net.Listener]struct{}), conns: make(map[net.Conn]struct{})}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func (s *tcpServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	s.lis[lis] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.lis, lis)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if s.idleTimeout > 0 {
+			conn = &idleConn{Conn: conn, timeout: s.idleTimeout}
+		}
+		if !s.track(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+			defer conn.Close()
+			s.handler(conn)
+		}()
+	}
+}
+
+// Stop closes the listeners and all the connections
+func (s *tcpServer) Stop() error {
+	s.closeListeners()
+	s.closeConns()
+	return nil
+}
+
+// GracefulStop closes the listeners and waits the connections to finish, the connections
+// are closed if they are not finished within the shutdownTimeout
+func (s *tcpServer) GracefulStop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.GracefulStopContext(ctx); err != context.DeadlineExceeded {
+		return err
+	}
+	return nil
+}
+
+// GracefulStopContext is like GracefulStop, besides the connections are waited until ctx is done, then they are
+// closed and ctx.Err() is returned. Cont calls it with the deadline of the DrainTimeout
+func (s *tcpServer) GracefulStopContext(ctx context.Context) error {
+	s.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var poll <-chan time.Time
+	if s.busy != nil {
+		s.closeQuiet()
+		ticker := time.NewTicker(quiescePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-poll:
+			s.closeQuiet()
+		case <-ctx.Done():
+			s.closeConns()
+			<-done
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *tcpServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track adds or removes a connection, it refuses to add when the server is closed. The connection is added to
+// the wait group under the same lock, so a graceful stop never misses a connection accepted meanwhile
+func (s *tcpServer) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *tcpServer) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for lis := range s.lis {
+		lis.Close()
+	}
+}
+
+func (s *tcpServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		s.closeConn(conn)
+	}
+}
+
+// closeQuiet closes the connections which are not busy
+func (s *tcpServer) closeQuiet() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		if !s.busy(conn) {
+			s.closeConn(conn)
+			// closed already, do not close it again on the next poll
+			delete(s.conns, conn)
+		}
+	}
+}
+
+// closeConn sends FIN and closes the connection after the grace period if CloseGrace is set
+func (s *tcpServer) closeConn(conn net.Conn) {
+	if s.closeGrace <= 0 {
+		conn.Close()
+		return
+	}
+	if cw, ok := closeWriter(conn); ok && cw.CloseWrite() == nil {
+		// the handler reads until the client closes or the deadline exceeds, then it returns and closes
+		conn.SetReadDeadline(time.Now().Add(s.closeGrace))
+		time.AfterFunc(s.closeGrace, func() {
+			conn.Close()
+		})
+		return
+	}
+	conn.Close()
+}
+
+type closeWriterConn interface {
+	CloseWrite() error
+}
+
+// closeWriter finds the connection which can close its writing side by unwrapping conn
+func closeWriter(conn net.Conn) (closeWriterConn, bool) {
+	for {
+		if cw, ok := conn.(closeWriterConn); ok {
+			return cw, true
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = nc.NetConn()
+	}
+}
+
+// idleConn closes itself when there is no data read or written within the timeout. The read deadline set on it,
+// e.g. by the handler or by closeConn under CloseGrace, is kept, the earlier of it and the idle deadline is used
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time // the read deadline set on the connection, zero if none
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(c.readDeadline()); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !c.expired() {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(c.readDeadline())
+}
+
+func (c *idleConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// readDeadline returns the earlier of the idle deadline and the one set on the connection
+func (c *idleConn) readDeadline() time.Time {
+	idle := time.Now().Add(c.timeout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.deadline.IsZero() && c.deadline.Before(idle) {
+		return c.deadline
+	}
+	return idle
+}
+
+// expired reports whether the deadline set on the connection has passed, so a timeout is not caused by idling
+func (c *idleConn) expired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
+// NetConn returns the underlying connection
+func (c *idleConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	// writing is an activity as well, so extend the deadline of the pending read
+	if err := c.Conn.SetReadDeadline(c.readDeadline()); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,270 @@
+package continuous
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTCP serves s on a local listener until the test ends
+func serveTCP(t *testing.T, s Continuous) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Stop() })
+	return lis
+}
+
+// echo copies the data back until the connection is closed
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	lis := serveTCP(t, WrapTCPServer(echo, IdleTimeout(100*time.Millisecond)))
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the idle connection: %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("idle connection is closed after %v, before the timeout", elapsed)
+	}
+}
+
+func TestTCPIdleTimeoutDeadline(t *testing.T) {
+	errc := make(chan error, 2)
+	s := WrapTCPServer(func(conn net.Conn) {
+		// the earlier deadline set by the handler is kept, and its timeout does not close the connection
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		errc <- err
+		conn.SetReadDeadline(time.Time{})
+		_, err = conn.Write([]byte("x"))
+		errc <- err
+	}, IdleTimeout(5*time.Second))
+	lis := serveTCP(t, s)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-errc:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("read before the deadline set by the handler: %v, want timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deadline set by the handler is overridden by the idle timeout")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("connection is closed by the deadline of the handler: %v", err)
+	}
+}
+
+func TestIdleConnKeepsDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &idleConn{Conn: server, timeout: 5 * time.Second}
+	defer conn.Close()
+
+	// like closeConn under CloseGrace, the deadline is set while the handler is reading
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	go client.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// the following read is not extended to the idle timeout
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read after the deadline: %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("read times out after %v, the deadline is reset by the idle timeout", elapsed)
+	}
+}
+
+func TestTCPGracefulStopWaitsConns(t *testing.T) {
+	release := make(chan struct{})
+	s := WrapTCPServer(func(conn net.Conn) { <-release })
+	lis := serveTCP(t, s)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond) // let the connection be accepted
+
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("graceful stop returns before the connection is finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("graceful stop does not return after the connection is finished")
+	}
+}
+
+// queryServer marks a connection busy while it executes the query, which is a byte taking the duration to execute
+type queryServer struct {
+	duration time.Duration
+	busy     sync.Map
+}
+
+func (qs *queryServer) handle(conn net.Conn) {
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		qs.busy.Store(conn, true)
+		time.Sleep(qs.duration)
+		conn.Write([]byte("done"))
+		qs.busy.Delete(conn)
+	}
+}
+
+func (qs *queryServer) isBusy(conn net.Conn) bool {
+	_, ok := qs.busy.Load(conn)
+	return ok
+}
+
+// closedWithin reports whether the connection is closed by the server within d
+func closedWithin(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := ioutil.ReadAll(conn)
+	return err == nil
+}
+
+func TestTCPBusyFunc(t *testing.T) {
+	qs := &queryServer{duration: 500 * time.Millisecond}
+	s := WrapTCPServer(qs.handle, BusyFunc(qs.isBusy), IdleTimeout(time.Minute))
+	lis := serveTCP(t, s)
+	idle, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busy.Write([]byte("q"))
+	time.Sleep(100 * time.Millisecond) // let the query begin
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.GracefulStop()
+	}()
+	if !closedWithin(idle, 200*time.Millisecond) {
+		t.Fatal("idle connection is not closed at once")
+	}
+	buf := make([]byte, 4)
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(busy, buf); err != nil || string(buf) != "done" {
+		t.Fatalf("busy connection is not drained: %q, %v", buf, err)
+	}
+	if !closedWithin(busy, 500*time.Millisecond) {
+		t.Fatal("drained connection is not closed")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPGracefulStopContext(t *testing.T) {
+	qs := &queryServer{duration: 2 * time.Second}
+	s := WrapTCPServer(qs.handle, BusyFunc(qs.isBusy))
+	lis := serveTCP(t, s)
+	busy, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busy.Write([]byte("q"))
+	time.Sleep(100 * time.Millisecond)
+
+	// the busy connection is waited until the deadline rather than the shutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout+500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.(contextStopper).GracefulStopContext(ctx)
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("graceful stop returns %v after %v, before the deadline", err, time.Since(start))
+	case <-time.After(shutdownTimeout + 200*time.Millisecond):
+	}
+	// the handler is still sleeping, the connection is closed beneath it
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Fatalf("graceful stop returns %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestTCPCloseGrace(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		opts  []TCPOption
+		reset bool
+	}{
+		{"abrupt", nil, true},
+		{"grace", []TCPOption{CloseGrace(time.Second)}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			accepted := make(chan struct{}, 1)
+			// the handler reads nothing, closing the connection with unread data resets it
+			s := WrapTCPServer(func(conn net.Conn) {
+				accepted <- struct{}{}
+				<-release
+			}, c.opts...)
+			lis := serveTCP(t, s)
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			<-accepted
+			if _, err := conn.Write([]byte("unread")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			s.Stop()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			if reset := err != nil && strings.Contains(err.Error(), syscall.ECONNRESET.Error()); reset != c.reset || (!reset && err != io.EOF) {
+				t.Fatalf("read after the force stop: %v, want reset %v", err, c.reset)
+			}
+		})
+	}
+}
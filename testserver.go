@@ -0,0 +1,90 @@
+package continuous
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TestServer is a Continuous which records the calls to it, it helps to test the lifecycle of Cont.
+// The accepted connections are closed immediately
+type TestServer struct {
+	// ServeDelay, StopDelay and GracefulStopDelay delay the corresponding calls
+	ServeDelay        time.Duration
+	StopDelay         time.Duration
+	GracefulStopDelay time.Duration
+	// ServeErr, StopErr and GracefulStopErr are returned by the corresponding calls,
+	// Serve returns ServeErr immediately if it is set
+	ServeErr        error
+	StopErr         error
+	GracefulStopErr error
+
+	mu    sync.Mutex
+	calls []string
+	once  sync.Once
+	done  chan struct{}
+}
+
+// NewTestServer creates a TestServer
+func NewTestServer() *TestServer {
+	return &TestServer{done: make(chan struct{})}
+}
+
+// Serve accepts and closes connections until the listener is closed or the server is stopped
+func (ts *TestServer) Serve(lis net.Listener) error {
+	time.Sleep(ts.ServeDelay)
+	ts.record("Serve")
+	if ts.ServeErr != nil {
+		return ts.ServeErr
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			conn.Close()
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ts.done:
+		lis.Close()
+		return nil
+	}
+}
+
+// Stop records the call and stops serving
+func (ts *TestServer) Stop() error {
+	time.Sleep(ts.StopDelay)
+	ts.record("Stop")
+	ts.once.Do(func() { close(ts.done) })
+	return ts.StopErr
+}
+
+// GracefulStop records the call and stops serving
+func (ts *TestServer) GracefulStop() error {
+	time.Sleep(ts.GracefulStopDelay)
+	ts.record("GracefulStop")
+	ts.once.Do(func() { close(ts.done) })
+	return ts.GracefulStopErr
+}
+
+// Calls returns the names of the methods called in order
+func (ts *TestServer) Calls() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	calls := make([]string, len(ts.calls))
+	copy(calls, ts.calls)
+	return calls
+}
+
+func (ts *TestServer) record(call string) {
+	ts.mu.Lock()
+	ts.calls = append(ts.calls, call)
+	ts.mu.Unlock()
+}
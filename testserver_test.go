@@ -0,0 +1,72 @@
+package continuous
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTestServer(t *testing.T) {
+	ts := NewTestServer()
+	ts.GracefulStopDelay = 100 * time.Millisecond
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ts.Serve(lis)
+	}()
+
+	// the accepted connections are closed at once
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+	conn.Close()
+
+	start := time.Now()
+	if err := ts.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("graceful stop returns after %v, before the delay", elapsed)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("serve returns %v after the graceful stop", err)
+	}
+	ts.Stop()
+	if got, want := fmt.Sprint(ts.Calls()), "[Serve GracefulStop Stop]"; got != want {
+		t.Fatalf("calls are %s, want %s", got, want)
+	}
+}
+
+func TestTestServerErrors(t *testing.T) {
+	cont := newTestCont(t)
+	ts := NewTestServer()
+	ts.StopErr = errors.New("stop failed")
+	if err := cont.AddServer(ts, &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	if err := cont.Stop(); err != ts.StopErr {
+		t.Fatalf("stop returns %v, want the error of the server", err)
+	}
+
+	failed := NewTestServer()
+	failed.ServeErr = errors.New("serve failed")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if err := failed.Serve(lis); err != failed.ServeErr {
+		t.Fatalf("serve returns %v, want ServeErr", err)
+	}
+}
@@ -0,0 +1,73 @@
+package continuous
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// binaryWatchInterval is the interval to check the executable file
+const binaryWatchInterval = time.Second
+
+// WatchBinary upgrades the process like SIGHUP when its executable file is replaced in place, it is useful for
+// development. Switching a symlink to another binary is not detected
+func WatchBinary(enable bool) Option {
+	return func(cont *Cont) {
+		cont.watchBinary = enable
+	}
+}
+
+// watch polls the executable file until stop is closed, an upgrade is triggered once the file has changed and
+// then stays the same for an interval, so a file which is still being written does not trigger it
+func (cont *Cont) watch(stop chan struct{}) {
+	// the path is resolved by os.Executable, e.g. the symlinks are followed on linux, so only replacing the binary
+	// in place is detected, switching a symlink to another binary is not
+	path := cont.exe
+	if path == "" {
+		cont.logger.Error("watch binary failed, executable path is unknown")
+		return
+	}
+	last, err := os.Stat(path)
+	if err != nil {
+		cont.logger.Error("watch binary failed", zap.Error(err), zap.String("path", path))
+		return
+	}
+	cont.logger.Info("watching binary", zap.String("path", path))
+
+	ticker := time.NewTicker(binaryWatchInterval)
+	defer ticker.Stop()
+	var pending os.FileInfo
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			// the file may be missing for a moment while it is replaced
+			continue
+		}
+		if sameFile(fi, last) {
+			pending = nil
+			continue
+		}
+		if pending == nil || !sameFile(fi, pending) {
+			pending = fi
+			continue
+		}
+		cont.logger.Info("binary changed, upgrading", zap.String("path", path))
+		last, pending = fi, nil
+		select {
+		case cont.triggers <- syscall.SIGHUP:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size() && os.SameFile(a, b)
+}
@@ -0,0 +1,39 @@
+package continuous
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchBinary(t *testing.T) {
+	cont := newTestCont(t)
+	cont.exe = filepath.Join(t.TempDir(), "app")
+	if err := ioutil.WriteFile(cont.exe, []byte("v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go cont.watch(stop)
+	time.Sleep(100 * time.Millisecond) // let the watcher stat the original binary
+
+	// replace the binary like a deployment does
+	tmp := cont.exe + ".new"
+	if err := ioutil.WriteFile(tmp, []byte("v2 is larger"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, cont.exe); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-cont.triggers:
+		if sig != syscall.SIGHUP {
+			t.Fatalf("triggered %v, want SIGHUP", sig)
+		}
+	case <-time.After(5 * binaryWatchInterval):
+		t.Fatal("upgrade is not triggered after the binary is replaced")
+	}
+}
@@ -0,0 +1,51 @@
+package continuous
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrRebindWorker is returned by AddWorker with RestartRebind, a worker has no listener to rebind
+var ErrRebindWorker = errors.New("rebind a worker")
+
+// Worker is a participant which does not serve a listener, for example a message queue consumer with a health
+// endpoint served by another server. Run blocks until the worker is stopped, GracefulStop should stop taking new
+// work and wait for the in-flight one to finish. Workers keep running when the listeners are paused by SIGUSR1
+type Worker interface {
+	Run() error
+	Stop() error
+	GracefulStop() error
+}
+
+// AddWorker adds a worker with the name, the options about listeners are ignored
+func (cont *Cont) AddWorker(w Worker, name string, opts ...ServerOption) error {
+	cs := &ContServer{srv: &workerServer{w}, listenOn: &ListenOn{}, name: name, conns: &connCounter{}}
+	for _, o := range opts {
+		o(cs)
+	}
+	if cs.restart == RestartRebind {
+		return ErrRebindWorker
+	}
+	cs.worker, cs.lazy = true, false
+	cont.servers = append(cont.servers, cs)
+	return nil
+}
+
+// startWorkers runs the workers, they are stopped with the servers
+func (cont *Cont) startWorkers() {
+	for _, server := range cont.servers {
+		if server.worker {
+			cont.workerWg.Add(1)
+			go cont.run(server, cont.stopping, &cont.workerWg)
+		}
+	}
+}
+
+// workerServer adapts a Worker to Continuous
+type workerServer struct {
+	Worker
+}
+
+func (ws *workerServer) Serve(lis net.Listener) error {
+	return ws.Run()
+}
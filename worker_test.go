@@ -0,0 +1,90 @@
+package continuous
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConsumer is a message queue consumer, its GracefulStop stops taking messages without waiting
+// the one in flight, which is finished by Run
+type testConsumer struct {
+	inFlight time.Duration
+	started  chan struct{}
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+func newTestConsumer(inFlight time.Duration) *testConsumer {
+	return &testConsumer{inFlight: inFlight, started: make(chan struct{}), stop: make(chan struct{}),
+		finished: make(chan struct{})}
+}
+
+func (c *testConsumer) Run() error {
+	close(c.started)
+	<-c.stop
+	time.Sleep(c.inFlight)
+	close(c.finished)
+	return nil
+}
+
+func (c *testConsumer) Stop() error {
+	close(c.stop)
+	return nil
+}
+
+func (c *testConsumer) GracefulStop() error {
+	close(c.stop)
+	return nil
+}
+
+func TestWorkerDrain(t *testing.T) {
+	sigs, source := signals()
+	cont := newTestCont(t, source, DrainTimeout(5*time.Second))
+	consumer := newTestConsumer(200 * time.Millisecond)
+	if err := cont.AddWorker(consumer, "consumer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.AddServer(NewTestServer(), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	<-consumer.started
+
+	sigs <- syscall.SIGQUIT
+	waitServe(t, errc)
+	select {
+	case <-consumer.finished:
+	default:
+		t.Fatal("serve returns before the message in flight is finished")
+	}
+}
+
+func TestWorkerStop(t *testing.T) {
+	sigs, source := signals()
+	cont := newTestCont(t, source)
+	consumer := newTestConsumer(200 * time.Millisecond)
+	if err := cont.AddWorker(consumer, "consumer"); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+	<-consumer.started
+
+	sigs <- syscall.SIGTERM
+	waitServe(t, errc)
+	select {
+	case <-consumer.finished:
+	default:
+		t.Fatal("serve returns before the worker returns")
+	}
+}
+
+func TestAddWorkerRebind(t *testing.T) {
+	cont := newTestCont(t)
+	if err := cont.AddWorker(newTestConsumer(0), "consumer", Restart(RestartRebind)); err != ErrRebindWorker {
+		t.Fatalf("add a worker with RestartRebind: %v, want ErrRebindWorker", err)
+	}
+	if len(cont.servers) != 0 {
+		t.Fatal("rejected worker is added")
+	}
+}
@@ -4,26 +4,157 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 )
 
+// shutdownTimeout is the time the http server waits for connections to finish before closing them
+const shutdownTimeout = time.Second
+
+// HTTPOption customs the http server created by WrapHTTPServer
+type HTTPOption func(s *httpServer)
+
+// OnShutdown registers fn on the http server by RegisterOnShutdown, it is called in a new goroutine when the graceful
+// stop begins, e.g. to notify the hijacked connections like websockets. It is not called by Stop
+func OnShutdown(fn func()) HTTPOption {
+	return func(s *httpServer) {
+		s.Server.RegisterOnShutdown(fn)
+	}
+}
+
 type httpServer struct {
 	*http.Server
+	critical *criticalRoutes
+	streams  *streams
+}
+
+func newHTTPServer(s *http.Server, opts ...HTTPOption) *httpServer {
+	hs := &httpServer{Server: s}
+	for _, o := range opts {
+		o(hs)
+	}
+	if hs.critical != nil {
+		hs.critical.install(s)
+	}
+	if hs.streams != nil {
+		hs.streams.install(s)
+	}
+	return hs
 }
 
 func (s *httpServer) Stop() error {
 	return s.Server.Close()
 }
 func (s *httpServer) GracefulStop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	return s.Server.Shutdown(ctx)
+	// the streams and the critical requests ended by the shutdown are the expected way to stop, so closing the
+	// server after the shutdownTimeout is not reported as a failure, unlike ShutdownOrClose
+	if err := s.shutdown(ctx, shutdownTimeout, s.grace()); err != context.DeadlineExceeded {
+		return err
+	}
+	return nil
 }
 
-func WrapHTTPServer(s *http.Server) Continuous {
-	return &httpServer{s}
+// ShutdownCloser is implemented by the http servers returned by WrapHTTPServer and WrapHTTPServerTLS
+type ShutdownCloser interface {
+	// ShutdownOrClose shuts down the server gracefully and closes it if the connections are not finished within
+	// the timeout, the streams of TrackStreams and the grace of CriticalRoutes are taken from the timeout as well.
+	// The error of the shutdown is returned wrapped if the server is closed, e.g. context.DeadlineExceeded
+	ShutdownOrClose(timeout time.Duration) error
+}
+
+func (s *httpServer) ShutdownOrClose(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return closed(s.GracefulStopContext(ctx))
+}
+
+// closeError is returned when the server is closed since the shutdown does not finish in time
+type closeError struct {
+	err error
+}
+
+func (e *closeError) Error() string {
+	return "server closed after the shutdown failed: " + e.err.Error()
+}
+
+// Unwrap returns the error of the shutdown, e.g. context.DeadlineExceeded
+func (e *closeError) Unwrap() error { return e.err }
+
+// closed wraps the error of a shutdown which is ended by closing the server
+func closed(err error) error {
+	if err == context.DeadlineExceeded {
+		return &closeError{err: err}
+	}
+	return err
+}
+
+// GracefulStopContext shuts down the server gracefully until ctx is done, then closes it and returns ctx.Err().
+// Cont calls it with the deadline of the DrainTimeout instead of GracefulStop, the grace of CriticalRoutes and the
+// wait for the streams to end are taken from the end of the drain then
+func (s *httpServer) GracefulStopContext(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return s.shutdown(ctx, shutdownTimeout, s.grace())
+	}
+	left := time.Until(deadline)
+	grace := s.grace()
+	if grace > left {
+		grace = left
+	}
+	var streamWait time.Duration
+	if s.streams != nil {
+		streamWait = shutdownTimeout
+		if half := (left - grace) / 2; streamWait > half {
+			streamWait = half
+		}
+	}
+	shutdownCtx, cancel := context.WithDeadline(ctx, deadline.Add(-grace-streamWait))
+	defer cancel()
+	return s.shutdown(shutdownCtx, streamWait, grace)
+}
+
+// shutdown shuts down the server gracefully until ctx is done, then ends the streams within streamWait and closes
+// the connections except the ones serving critical requests, which are waited for the grace before the server is closed
+func (s *httpServer) shutdown(ctx context.Context, streamWait, grace time.Duration) error {
+	if err := s.Server.Shutdown(ctx); err == nil || ctx.Err() == nil {
+		return err
+	}
+	// end the streams first, they never finish by themselves
+	if s.streams != nil {
+		s.streams.stop(streamWait)
+	}
+	if s.critical != nil {
+		s.critical.drain(grace)
+	}
+	if err := s.Server.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// grace returns the grace period of the critical requests
+func (s *httpServer) grace() time.Duration {
+	if s.critical == nil {
+		return 0
+	}
+	return s.critical.grace
+}
+
+// CancelContexts cancels the contexts of the requests in flight, it only works with TrackStreams
+func (s *httpServer) CancelContexts() {
+	if s.streams != nil {
+		s.streams.cancel()
+	}
+}
+
+// WrapHTTPServer wraps s as a Continuous, which implements ShutdownCloser and ContextCanceler as well
+func WrapHTTPServer(s *http.Server, opts ...HTTPOption) Continuous {
+	return newHTTPServer(s, opts...)
 }
 
 type httpServerTLS struct {
@@ -32,15 +163,30 @@ type httpServerTLS struct {
 	keyFile  string
 }
 
-func WrapHTTPServerTLS(s *http.Server, certFile, keyFile string) Continuous {
-	return &httpServerTLS{httpServer: &httpServer{s}, certFile: certFile, keyFile: keyFile}
+// WrapHTTPServerTLS wraps s like WrapHTTPServer, it serves TLS with the certificate and key files
+func WrapHTTPServerTLS(s *http.Server, certFile, keyFile string, opts ...HTTPOption) Continuous {
+	return &httpServerTLS{httpServer: newHTTPServer(s, opts...), certFile: certFile, keyFile: keyFile}
 }
 func (s *httpServerTLS) Serve(lis net.Listener) error {
 	return s.ServeTLS(lis, s.certFile, s.keyFile)
 }
 
+// GRPCOption customs the grpc server created by WrapGRPCServer
+type GRPCOption func(s *grpcServer)
+
+// HealthServer sets all the services of hs to NOT_SERVING before the graceful stop, and waits
+// the grace period for the clients and load balancers to notice
+func HealthServer(hs *health.Server, grace time.Duration) GRPCOption {
+	return func(s *grpcServer) {
+		s.health = hs
+		s.healthGrace = grace
+	}
+}
+
 type grpcServer struct {
 	*grpc.Server
+	health      *health.Server
+	healthGrace time.Duration
 }
 
 func (s *grpcServer) Stop() error {
@@ -48,10 +194,82 @@ func (s *grpcServer) Stop() error {
 	return nil
 }
 func (s *grpcServer) GracefulStop() error {
+	s.notServing(nil)
 	s.Server.GracefulStop()
 	return nil
 }
 
-func WrapGRPCServer(s *grpc.Server) Continuous {
-	return &grpcServer{s}
+// notServing flips the health status to NOT_SERVING and waits the grace period or until done is closed
+func (s *grpcServer) notServing(done <-chan struct{}) {
+	if s.health == nil {
+		return
+	}
+	s.health.Shutdown()
+	select {
+	case <-time.After(s.healthGrace):
+	case <-done:
+	}
+}
+
+func WrapGRPCServer(s *grpc.Server, opts ...GRPCOption) Continuous {
+	return newGRPCServer(s, opts)
+}
+
+func newGRPCServer(s *grpc.Server, opts []GRPCOption) *grpcServer {
+	gs := &grpcServer{Server: s}
+	for _, o := range opts {
+		o(gs)
+	}
+	return gs
+}
+
+type grpcServerContext struct {
+	*grpcServer
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// WrapGRPCServerContext wraps s like WrapGRPCServer, besides its graceful stop can be abandoned, so s is stopped by force.
+// Cont abandons it when the DrainTimeout exceeds
+func WrapGRPCServerContext(s *grpc.Server, opts ...GRPCOption) Continuous {
+	return &grpcServerContext{grpcServer: newGRPCServer(s, opts)}
+}
+
+// Stop abandons the pending graceful stop and stops the server by force
+func (s *grpcServerContext) Stop() error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.Server.Stop()
+	return nil
+}
+
+func (s *grpcServerContext) GracefulStop() error {
+	return s.GracefulStopContext(context.Background())
+}
+
+// GracefulStopContext stops the server gracefully until ctx is done, then stops it by force and returns ctx.Err()
+func (s *grpcServerContext) GracefulStopContext(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	s.notServing(ctx.Done())
+	done := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Server.Stop()
+		<-done
+		return ctx.Err()
+	}
 }
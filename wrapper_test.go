@@ -0,0 +1,259 @@
+package continuous
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// get requests the path of the server and returns the body
+func get(addr, path string) (string, error) {
+	resp, err := http.Get("http://" + addr + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestHTTPDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// longer than the shutdownTimeout, but within the DrainTimeout
+		time.Sleep(shutdownTimeout + 500*time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	sigs, source := signals()
+	cont := newTestCont(t, source, DrainTimeout(5*time.Second))
+	if err := cont.AddServer(WrapHTTPServer(srv), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	errc := serveAsync(t, cont)
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		body, err := get(cont.servers[0].addr.String(), "/")
+		resc <- result{body, err}
+	}()
+	<-started
+	sigs <- syscall.SIGQUIT
+	if err := waitServe(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-resc; r.err != nil || r.body != "done" {
+		t.Fatalf("request in flight got %q, %v", r.body, r.err)
+	}
+}
+
+func TestShutdownOrClose(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})}
+	s := WrapHTTPServer(srv)
+	lis := serveTCP(t, s)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := get(lis.Addr().String(), "/")
+		errc <- err
+	}()
+	<-started
+
+	// the blocking handler never finishes, the server is closed after the timeout
+	start := time.Now()
+	err := s.(ShutdownCloser).ShutdownOrClose(200 * time.Millisecond)
+	if ce, ok := err.(interface{ Unwrap() error }); !ok || ce.Unwrap() != context.DeadlineExceeded {
+		t.Fatalf("shutdown returns %v, want the deadline exceeded wrapped", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("shutdown returns after %v, want the fallback to close after the timeout", elapsed)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("request in flight is not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed by the fallback")
+	}
+}
+
+func TestShutdownOrCloseIdle(t *testing.T) {
+	s := WrapHTTPServer(&http.Server{Handler: http.NotFoundHandler()})
+	serveTCP(t, s)
+	start := time.Now()
+	if err := s.(ShutdownCloser).ShutdownOrClose(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("idle server shuts down after %v", elapsed)
+	}
+}
+
+func TestShutdownOrCloseBounded(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})}
+	// the critical request and the stream wait are taken from the timeout rather than added to it
+	s := WrapHTTPServer(srv, CriticalRoutes(func(r *http.Request) bool { return true }, 5*time.Second), TrackStreams())
+	lis := serveTCP(t, s)
+	go get(lis.Addr().String(), "/")
+	<-started
+
+	start := time.Now()
+	if err := s.(ShutdownCloser).ShutdownOrClose(300 * time.Millisecond); err == nil {
+		t.Fatal("shutdown of a critical request in flight succeeds")
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Fatalf("shutdown returns after %v, want it bounded by the timeout", elapsed)
+	}
+}
+
+// blockingGRPCServer creates a grpc server whose stream /test.Blocking/Wait blocks until the stream is canceled
+func blockingGRPCServer(started chan<- struct{}) *grpc.Server {
+	s := grpc.NewServer()
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Blocking",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName: "Wait",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				started <- struct{}{}
+				<-stream.Context().Done()
+				return stream.Context().Err()
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, struct{}{})
+	return s
+}
+
+func TestGRPCGracefulStopContext(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cont := newTestCont(t, DrainTimeout(500*time.Millisecond))
+	if err := cont.AddServer(WrapGRPCServerContext(blockingGRPCServer(started)), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+
+	conn, err := grpc.Dial(cont.servers[0].addr.String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/test.Blocking/Wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is not started")
+	}
+
+	// the stream never ends, the graceful stop is abandoned when the drain exceeds
+	start := time.Now()
+	report, err := cont.GracefulStopReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second || !report.Servers[0].Forced {
+		t.Fatalf("graceful stop returns after %v, report %+v, want forced after the drain timeout", elapsed, report)
+	}
+	if err := stream.RecvMsg(new(interface{})); status.Code(err) != codes.Unavailable {
+		t.Fatalf("stream receives %v, want broken by the force stop", err)
+	}
+}
+
+func TestGRPCHealthServer(t *testing.T) {
+	hs := health.NewServer()
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	cont := newTestCont(t)
+	if err := cont.AddServer(WrapGRPCServer(s, HealthServer(hs, time.Second)), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	startServing(t, cont)
+	conn, err := grpc.Dial(cont.servers[0].addr.String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	check := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	if status := check(); status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("health is %v before stopping", status)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cont.GracefulStop()
+	}()
+	// the status is flipped while the server still serves during the grace period
+	for i := 0; check() != healthpb.HealthCheckResponse_NOT_SERVING; i++ {
+		if i == 50 {
+			t.Fatal("health is not flipped to NOT_SERVING before the graceful stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPOnShutdown(t *testing.T) {
+	called := make(chan struct{}, 2)
+	notify := OnShutdown(func() { called <- struct{}{} })
+	stopped := newTestCont(t)
+	graceful := newTestCont(t)
+	for _, cont := range []*Cont{stopped, graceful} {
+		if err := cont.AddServer(WrapHTTPServer(&http.Server{}, notify), &ListenOn{"tcp", "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+		startServing(t, cont)
+	}
+
+	stopped.Stop()
+	select {
+	case <-called:
+		t.Fatal("shutdown callback is called by stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := graceful.GracefulStop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown callback is not called by the graceful stop")
+	}
+}